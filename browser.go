@@ -7,11 +7,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"maps"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/chromedp/cdproto/page"
 	cdpruntime "github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
 )
@@ -22,19 +26,17 @@ const (
 )
 
 var DefaultBrowserFlags = BrowserFlags{
-	"kiosk":                          true,
-	"no-default-browser-check":       true,
-	"remote-debugging-port":          remoteDebuggingPort,
-	"no-sandbox":                     true,
-	"disable-infobars":               true,
-	"noerrdialogs":                   true,
-	"enable-automation":              false,
-	"disable-crash-report":           true,
-	"ignore-certificate-errors":      true,
-	"bwsi":                           true,
-	"disable-extensions":             true,
-	"allow-insecure-localhost":       true,
-	"allow-running-insecure-content": true,
+	"kiosk":                    true,
+	"no-default-browser-check": true,
+	"remote-debugging-port":    remoteDebuggingPort,
+	"no-sandbox":               true,
+	"disable-infobars":         true,
+	"noerrdialogs":             true,
+	"enable-automation":        false,
+	"disable-crash-report":     true,
+	"bwsi":                     true,
+	"disable-extensions":       true,
+	"allow-insecure-localhost": true,
 
 	// "unsafely-treat-insecure-origin-as-secure": "http://62mh.net",
 	// "proxy-server":                             "http://127.0.0.1:9999",
@@ -66,6 +68,10 @@ const (
 	DefaultStartUrl  = "blank:black"
 
 	DataUrlBgcolorFmt = `<style>html{background-color:%s}</style>`
+
+	// Requests shortly after a page has finished loading are still
+	// attributed to it.
+	loadSettleTime = 2 * time.Second
 )
 
 type Browser struct {
@@ -78,8 +84,13 @@ type Browser struct {
 	CmdOutput       io.Writer
 	ExecArgsPrefix  []string
 	UserDataDir     string
-	TraceLog        *log.Logger
-	ConsoleLog      *log.Logger
+
+	// Logger receives console messages at Info and, at Debug, every
+	// DevTools event. If it is nil, ConsoleLog and TraceLog are used
+	// through NewLogHandler, if set.
+	Logger     *slog.Logger
+	TraceLog   *log.Logger
+	ConsoleLog *log.Logger
 
 	RunCtx     context.Context
 	RunArgs    []string
@@ -87,6 +98,14 @@ type Browser struct {
 
 	navigateOpc chan *browserNavigateOp
 	evalOpc     chan *browserEvalOp
+
+	loadingMu     sync.Mutex
+	loadingFrames map[string]struct{}
+	loadedAt      time.Time
+
+	loggersOnce sync.Once
+	console     *slog.Logger
+	trace       *slog.Logger
 }
 
 type browserNavigateOp struct {
@@ -122,6 +141,10 @@ func (br *Browser) Init() error {
 }
 
 func (br *Browser) Run(ctx context.Context) error {
+	br.loadingMu.Lock()
+	br.loadingFrames = nil
+	br.loadingMu.Unlock()
+
 	ctx, cancel := br.setup(ctx)
 	defer cancel()
 
@@ -167,7 +190,7 @@ func (br *Browser) setup(ctx context.Context) (context.Context, func()) {
 		cancel0()
 	}
 
-	chromedp.ListenTarget(ctx, br.listenTarget)
+	chromedp.ListenTarget(ctx, func(ev any) { br.listenTarget(ctx, ev) })
 
 	br.RunCtx = ctx
 
@@ -248,8 +271,16 @@ func (br *Browser) dataUrlHtml(html string) string {
 	return "data:text/html;base64," + base64.StdEncoding.EncodeToString([]byte(html))
 }
 
-func (br *Browser) listenTarget(ev any) {
-	if logger := br.ConsoleLog; logger != nil {
+func (br *Browser) listenTarget(ctx context.Context, ev any) {
+	switch ev := ev.(type) {
+	case *page.EventFrameStartedLoading:
+		br.setLoading(string(ev.FrameID), true)
+
+	case *page.EventFrameStoppedLoading:
+		br.setLoading(string(ev.FrameID), false)
+	}
+
+	if logger := br.consoleLogger(); logger.Enabled(ctx, slog.LevelInfo) {
 		if ev, ok := ev.(*cdpruntime.EventConsoleAPICalled); ok {
 			var args []any
 			for _, arg := range ev.Args {
@@ -259,19 +290,68 @@ func (br *Browser) listenTarget(ev any) {
 			}
 
 			if len(args) > 0 {
-				logger.Printf("console %s: %+v", ev.Type, args)
+				logger.Info("console", "target_id", targetID(ctx), "type", ev.Type, "args", fmt.Sprintf("%+v", args))
 			}
 		}
 	}
 
-	if logger := br.TraceLog; logger != nil {
+	if logger := br.traceLogger(); logger.Enabled(ctx, slog.LevelDebug) {
 		out, err := json.Marshal(ev)
 		if err == nil {
-			logger.Printf("Event %T: %+v", ev, string(out))
+			logger.Debug("event", "target_id", targetID(ctx), "type", fmt.Sprintf("%T", ev), "event", json.RawMessage(out))
 		}
 	}
 }
 
+// consoleLogger and traceLogger return the loggers for console messages
+// and DevTools events, which are built on first use.
+func (br *Browser) consoleLogger() *slog.Logger {
+	br.loggersOnce.Do(br.initLoggers)
+	return br.console
+}
+
+func (br *Browser) traceLogger() *slog.Logger {
+	br.loggersOnce.Do(br.initLoggers)
+	return br.trace
+}
+
+func (br *Browser) initLoggers() {
+	br.console = logger(br.Logger, br.ConsoleLog, slog.LevelInfo).With("component", "browser")
+	br.trace = logger(br.Logger, br.TraceLog, slog.LevelDebug).With("component", "browser")
+}
+
+func targetID(ctx context.Context) string {
+	if c := chromedp.FromContext(ctx); c != nil && c.Target != nil {
+		return string(c.Target.TargetID)
+	}
+	return ""
+}
+
+func (br *Browser) setLoading(frameID string, loading bool) {
+	br.loadingMu.Lock()
+	defer br.loadingMu.Unlock()
+
+	if loading {
+		if br.loadingFrames == nil {
+			br.loadingFrames = make(map[string]struct{})
+		}
+		br.loadingFrames[frameID] = struct{}{}
+	} else {
+		delete(br.loadingFrames, frameID)
+	}
+
+	br.loadedAt = time.Now()
+}
+
+// Loading reports whether any frame of the page is loading, or finished
+// loading within loadSettleTime.
+func (br *Browser) Loading() bool {
+	br.loadingMu.Lock()
+	defer br.loadingMu.Unlock()
+
+	return len(br.loadingFrames) > 0 || time.Since(br.loadedAt) < loadSettleTime
+}
+
 func (br *Browser) Navigate(urlStr string) error {
 	var op = browserNavigateOp{
 		urlStr: urlStr,
@@ -289,7 +369,15 @@ func (br *Browser) handleNavigate(ctx context.Context, op *browserNavigateOp) {
 	)
 
 	urlStr = br.effectiveUrl(urlStr)
-	errc <- chromedp.Run(ctx, chromedp.Navigate(urlStr))
+
+	err := chromedp.Run(ctx, chromedp.Navigate(urlStr))
+
+	metricBrowserNavigations.Inc()
+	if err != nil {
+		metricBrowserNavigationFailures.Inc()
+	}
+
+	errc <- err
 }
 
 func (br *Browser) EvalJS(code string) ([]byte, error) {
@@ -326,5 +414,9 @@ func (br *Browser) handleEval(ctx context.Context, op *browserEvalOp) {
 		errc   = op.errc
 	)
 
-	errc <- chromedp.Run(ctx, chromedp.Evaluate(code, &result))
+	start := time.Now()
+	err := chromedp.Run(ctx, chromedp.Evaluate(code, &result))
+	metricBrowserEvalLatency.Observe(time.Since(start).Seconds())
+
+	errc <- err
 }
@@ -0,0 +1,526 @@
+package chromekiosk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CacheStatus string
+
+const (
+	CacheBypass      CacheStatus = "BYPASS"
+	CacheMiss        CacheStatus = "MISS"
+	CacheHit         CacheStatus = "HIT"
+	CacheRevalidated CacheStatus = "REVALIDATED"
+	CacheStale       CacheStatus = "STALE"
+)
+
+const maxHeuristicFreshness = 24 * time.Hour
+
+// Cache is an on-disk HTTP cache for proxied GET requests. It honours
+// Cache-Control, ETag and Last-Modified, and when upstream is unreachable or
+// failing it falls back to stale entries (see StaleIfError).
+//
+// Every successful response that is not marked no-store or private, and not
+// for a request with cookies or credentials, is kept, even if it is not
+// fresh, so that it can be served while offline. Entries for hosts
+// matching Pinned are never evicted to stay under MaxBytes.
+type Cache struct {
+	Dir      string
+	MaxBytes int64
+	Pinned   []string
+
+	// StaleIfError bounds how long past expiry an entry may be served when
+	// upstream fails, unless the response set its own stale-if-error. Zero
+	// means no limit.
+	StaleIfError time.Duration
+
+	loadOnce sync.Once
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	size     int64
+}
+
+type cacheEntry struct {
+	Key          string
+	URL          string
+	Host         string
+	Status       int
+	Header       http.Header
+	Vary         map[string]string
+	Stored       time.Time
+	Expires      time.Time
+	StaleIfError time.Duration
+	Size         int64
+	Accessed     time.Time
+}
+
+func cacheKey(urlStr string) string {
+	sum := sha256.Sum256([]byte(urlStr))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) metaPath(key string) string { return filepath.Join(c.Dir, key+".json") }
+func (c *Cache) bodyPath(key string) string { return filepath.Join(c.Dir, key+".body") }
+
+func (c *Cache) load() {
+	c.entries = make(map[string]*cacheEntry)
+
+	names, _ := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+
+		var e cacheEntry
+		if err := json.Unmarshal(data, &e); err != nil || e.Key == "" {
+			os.Remove(name)
+			continue
+		}
+
+		c.entries[e.Key] = &e
+		c.size += e.Size
+	}
+}
+
+func (c *Cache) lookup(req *http.Request) *cacheEntry {
+	c.loadOnce.Do(c.load)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[cacheKey(req.URL.String())]
+	if !ok {
+		return nil
+	}
+
+	for k, v := range e.Vary {
+		if req.Header.Get(k) != v {
+			return nil
+		}
+	}
+
+	e.Accessed = time.Now()
+	return e.clone()
+}
+
+// clone returns a copy of e that can be used without holding c.mu.
+func (e *cacheEntry) clone() *cacheEntry {
+	e2 := *e
+	e2.Header = e.Header.Clone()
+	e2.Vary = maps.Clone(e.Vary)
+	return &e2
+}
+
+func (c *Cache) pinned(e *cacheEntry) bool {
+	return matchHostGlobs(c.Pinned, e.Host)
+}
+
+func (c *Cache) roundTrip(req *http.Request, rt http.RoundTripper) (*http.Response, CacheStatus, error) {
+	if !cacheableRequest(req) {
+		resp, err := rt.RoundTrip(req)
+		return resp, CacheBypass, err
+	}
+
+	var (
+		e   = c.lookup(req)
+		now = time.Now()
+	)
+
+	if e == nil {
+		// If the client has its own copy, a 304 is passed on and nothing
+		// is stored.
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return nil, CacheMiss, err
+		}
+
+		return c.store(req, resp), CacheMiss, nil
+	}
+
+	if now.Before(e.Expires) && !hasDirective(req.Header, "Cache-Control", "no-cache") {
+		resp, err := c.serve(req, e)
+		if err == nil {
+			return resp, CacheHit, nil
+		}
+	}
+
+	creq := req.Clone(req.Context())
+	creq.Header.Del("If-None-Match")
+	creq.Header.Del("If-Modified-Since")
+
+	if etag := e.Header.Get("Etag"); etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+
+	if lastMod := e.Header.Get("Last-Modified"); lastMod != "" {
+		creq.Header.Set("If-Modified-Since", lastMod)
+	}
+
+	resp, err := rt.RoundTrip(creq)
+
+	if err != nil || resp.StatusCode >= 500 {
+		if c.staleUsable(e, now) {
+			if cached, serr := c.serve(req, e); serr == nil {
+				if resp != nil {
+					resp.Body.Close()
+				}
+				return cached, CacheStale, nil
+			}
+		}
+
+		return resp, CacheMiss, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		c.revalidate(e, resp)
+
+		cached, err := c.serve(req, e)
+		if err == nil {
+			return cached, CacheRevalidated, nil
+		}
+
+		// The body went missing underneath us, so start over.
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return nil, CacheMiss, err
+		}
+		return c.store(req, resp), CacheMiss, nil
+	}
+
+	return c.store(creq, resp), CacheMiss, nil
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+
+	// The cache is shared, so nothing personal to the client is kept.
+	for _, k := range []string{"Range", "Authorization", "Cookie", "Upgrade"} {
+		if req.Header.Get(k) != "" {
+			return false
+		}
+	}
+
+	return !hasDirective(req.Header, "Cache-Control", "no-store")
+}
+
+func (c *Cache) staleUsable(e *cacheEntry, now time.Time) bool {
+	limit := e.StaleIfError
+	if limit == 0 {
+		limit = c.StaleIfError
+	}
+
+	return limit == 0 || now.Before(e.Expires.Add(limit))
+}
+
+func (c *Cache) serve(req *http.Request, e *cacheEntry) (*http.Response, error) {
+	f, err := os.Open(c.bodyPath(e.Key))
+	if err != nil {
+		c.remove(e.Key)
+		return nil, err
+	}
+
+	hdr := e.Header.Clone()
+	hdr.Set("Age", strconv.Itoa(int(time.Since(e.Stored).Seconds())))
+
+	return &http.Response{
+		Status:        strconv.Itoa(e.Status) + " " + http.StatusText(e.Status),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        hdr,
+		Body:          f,
+		ContentLength: e.Size,
+		Request:       req,
+	}, nil
+}
+
+// revalidate updates e, a copy from lookup, with the headers of a 304
+// response, and the cached entry too if its body has not been replaced.
+func (c *Cache) revalidate(e *cacheEntry, resp *http.Response) {
+	etag := e.Header.Get("Etag")
+
+	for _, k := range []string{"Cache-Control", "Date", "Etag", "Expires", "Last-Modified"} {
+		if vs, ok := resp.Header[k]; ok {
+			e.Header[k] = vs
+		}
+	}
+
+	e.Stored, e.Expires, e.StaleIfError = cacheFreshness(e.Header, time.Now())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cur, ok := c.entries[e.Key]; ok && cur.Size == e.Size && cur.Header.Get("Etag") == etag {
+		c.entries[e.Key] = e.clone()
+		c.writeMeta(e)
+	}
+}
+
+func (c *Cache) store(req *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+
+	if hasDirective(resp.Header, "Cache-Control", "no-store") || hasDirective(resp.Header, "Cache-Control", "private") ||
+		resp.Header.Get("Set-Cookie") != "" {
+		return resp
+	}
+
+	e := &cacheEntry{
+		Key:      cacheKey(req.URL.String()),
+		URL:      req.URL.String(),
+		Host:     req.URL.Hostname(),
+		Status:   resp.StatusCode,
+		Header:   resp.Header.Clone(),
+		Accessed: time.Now(),
+	}
+
+	for _, k := range resp.Header.Values("Vary") {
+		for _, k := range strings.Split(k, ",") {
+			k = strings.TrimSpace(k)
+			if k == "*" {
+				return resp
+			}
+
+			if k != "" {
+				if e.Vary == nil {
+					e.Vary = make(map[string]string)
+				}
+				e.Vary[http.CanonicalHeaderKey(k)] = req.Header.Get(k)
+			}
+		}
+	}
+
+	e.Stored, e.Expires, e.StaleIfError = cacheFreshness(resp.Header, time.Now())
+
+	if err := mkdirAll(c.Dir, 0o755); err != nil {
+		return resp
+	}
+
+	f, err := os.CreateTemp(c.Dir, "tmp-*")
+	if err != nil {
+		return resp
+	}
+
+	resp.Body = &cacheBodyWriter{
+		ReadCloser: resp.Body,
+		c:          c,
+		e:          e,
+		f:          f,
+		expect:     resp.ContentLength,
+	}
+
+	return resp
+}
+
+// cacheFreshness computes when a response was generated, when it stops
+// being fresh, and any stale-if-error allowance it grants.
+func cacheFreshness(hdr http.Header, now time.Time) (stored, expires time.Time, staleIfError time.Duration) {
+	stored = now
+	if date, err := http.ParseTime(hdr.Get("Date")); err == nil && date.Before(now) {
+		stored = date
+	}
+
+	if n, ok := directiveSeconds(hdr, "stale-if-error"); ok {
+		staleIfError = n
+	}
+
+	if hasDirective(hdr, "Cache-Control", "no-cache") {
+		return stored, stored, staleIfError
+	}
+
+	if n, ok := directiveSeconds(hdr, "max-age"); ok {
+		return stored, stored.Add(n), staleIfError
+	}
+
+	if exp := hdr.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return stored, stored, staleIfError
+		}
+		return stored, t, staleIfError
+	}
+
+	if lastMod, err := http.ParseTime(hdr.Get("Last-Modified")); err == nil && lastMod.Before(stored) {
+		return stored, stored.Add(min(stored.Sub(lastMod)/10, maxHeuristicFreshness)), staleIfError
+	}
+
+	return stored, stored, staleIfError
+}
+
+func directiveSeconds(hdr http.Header, name string) (time.Duration, bool) {
+	for _, v := range hdr.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(d), "=")
+			if !ok || !strings.EqualFold(k, name) {
+				continue
+			}
+
+			n, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+			if err != nil || n < 0 {
+				return 0, false
+			}
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+func hasDirective(hdr http.Header, key, name string) bool {
+	for _, v := range hdr.Values(key) {
+		for _, d := range strings.Split(v, ",") {
+			d, _, _ = strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(d, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheBodyWriter copies a response body to a temporary file as the client
+// reads it, and commits it to the cache only once the body has been read in
+// full.
+type cacheBodyWriter struct {
+	io.ReadCloser
+	c      *Cache
+	e      *cacheEntry
+	f      *os.File
+	n      int64
+	expect int64
+	failed bool
+}
+
+func (w *cacheBodyWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+
+	if n > 0 && !w.failed && w.f != nil {
+		if _, werr := w.f.Write(p[:n]); werr != nil {
+			w.failed = true
+		}
+		w.n += int64(n)
+	}
+
+	if errors.Is(err, io.EOF) && w.f != nil {
+		w.finish(!w.failed && (w.expect < 0 || w.expect == w.n))
+	}
+
+	return n, err
+}
+
+func (w *cacheBodyWriter) Close() error {
+	if w.f != nil {
+		w.finish(false)
+	}
+	return w.ReadCloser.Close()
+}
+
+func (w *cacheBodyWriter) finish(commit bool) {
+	f := w.f
+	w.f = nil
+
+	name := f.Name()
+	if err := f.Close(); err != nil || !commit {
+		os.Remove(name)
+		return
+	}
+
+	w.e.Size = w.n
+	w.c.commit(w.e, name)
+}
+
+func (c *Cache) commit(e *cacheEntry, bodyTmp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(bodyTmp, c.bodyPath(e.Key)); err != nil {
+		os.Remove(bodyTmp)
+		return
+	}
+
+	if old, ok := c.entries[e.Key]; ok {
+		c.size -= old.Size
+	}
+
+	c.entries[e.Key] = e
+	c.size += e.Size
+	c.writeMeta(e)
+
+	c.evict()
+}
+
+func (c *Cache) writeMeta(e *cacheEntry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	writeFileAtomic(c.metaPath(e.Key), data, 0o644)
+}
+
+func (c *Cache) evict() {
+	if c.MaxBytes <= 0 || c.size <= c.MaxBytes {
+		return
+	}
+
+	var victims []*cacheEntry
+	for _, e := range c.entries {
+		if !c.pinned(e) {
+			victims = append(victims, e)
+		}
+	}
+
+	slices.SortFunc(victims, func(a, b *cacheEntry) int { return a.Accessed.Compare(b.Accessed) })
+
+	for _, e := range victims {
+		if c.size <= c.MaxBytes {
+			break
+		}
+		c.removeLocked(e.Key)
+	}
+}
+
+func (c *Cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(key)
+}
+
+func (c *Cache) removeLocked(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Size
+		delete(c.entries, key)
+	}
+
+	os.Remove(c.metaPath(key))
+	os.Remove(c.bodyPath(key))
+}
+
+// Size returns the total size of cached bodies, in bytes.
+func (c *Cache) Size() int64 {
+	c.loadOnce.Do(c.load)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
@@ -0,0 +1,169 @@
+package chromekiosk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	var (
+		hits    atomic.Int32
+		offline atomic.Bool
+	)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		if offline.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=3600")
+
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=3600")
+		}
+
+		io.WriteString(w, "body "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	var pr = Proxy{
+		Cache: &Cache{Dir: t.TempDir()},
+	}
+
+	get := func(path string) (int, string) {
+		t.Helper()
+
+		r := httptest.NewRequest("GET", upstream.URL+path, nil)
+		if path == "/cookie" {
+			r.Header.Set("Cookie", "s=1")
+		}
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	// A client with its own copy is passed upstream's 304 on a miss.
+	r := httptest.NewRequest("GET", upstream.URL+"/etag", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("client validator: got %d", w.Code)
+	}
+
+	var testcases = []struct {
+		path   string
+		hits   int32
+		status int
+	}{
+		{"/fresh", 1, 200},
+		{"/fresh", 0, 200},
+		{"/etag", 1, 200},
+		{"/etag", 1, 200},
+		{"/nostore", 1, 200},
+		{"/nostore", 1, 200},
+		{"/private", 1, 200},
+		{"/private", 1, 200},
+		{"/cookie", 1, 200},
+		{"/cookie", 1, 200},
+	}
+
+	for _, tc := range testcases {
+		before := hits.Load()
+
+		code, body := get(tc.path)
+		if code != tc.status || body != "body "+tc.path {
+			t.Errorf("%s: got %d %q", tc.path, code, body)
+		}
+
+		if n := hits.Load() - before; n != tc.hits {
+			t.Errorf("%s: %d upstream hits, expect %d", tc.path, n, tc.hits)
+		}
+	}
+
+	offline.Store(true)
+
+	if code, body := get("/etag"); code != 200 || body != "body /etag" {
+		t.Errorf("stale-if-error: got %d %q", code, body)
+	}
+
+	if code, _ := get("/nostore"); code != http.StatusServiceUnavailable {
+		t.Errorf("no-store while offline: got %d", code)
+	}
+
+	if size := pr.Cache.Size(); size != int64(len("body /fresh")+len("body /etag")) {
+		t.Errorf("cache size %d", size)
+	}
+
+	reloaded := Cache{Dir: pr.Cache.Dir}
+	if size := reloaded.Size(); size != pr.Cache.Size() {
+		t.Errorf("reloaded cache size %d", size)
+	}
+}
+
+func TestCachePrivate(t *testing.T) {
+	var hits atomic.Int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		io.WriteString(w, r.Header.Get("Authorization")+r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+
+	creds, err := NewCredentials([]CredentialRule{{Hosts: []string{"127.0.0.1"}, Bearer: &Secret{Value: "t"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{
+		Cache:   &Cache{Dir: t.TempDir()},
+		Cookies: &CookieJar{},
+	}
+	pr.SetCredentials(creds)
+
+	if err := pr.Cookies.Seed([]CookieSeed{{Domain: "localhost", Name: "s", Value: Secret{Value: "1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []string{upstream.URL, strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)} {
+		for range 2 {
+			w := httptest.NewRecorder()
+			pr.ServeHTTP(w, httptest.NewRequest("GET", u+"/private", nil))
+			if w.Body.Len() == 0 {
+				t.Errorf("%s: no credentials sent", u)
+			}
+		}
+	}
+
+	if n := hits.Load(); n != 4 {
+		t.Errorf("%d upstream hits, expect 4", n)
+	}
+
+	if size := pr.Cache.Size(); size != 0 {
+		t.Errorf("cache size %d", size)
+	}
+}
@@ -0,0 +1,291 @@
+package chromekiosk
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertValidity = 365 * 24 * time.Hour
+	caCertRenew    = 30 * 24 * time.Hour
+
+	leafCertValidity = 7 * 24 * time.Hour
+	leafCertRenew    = time.Hour
+
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+
+	// The least recently used leaf certificates are dropped past this many.
+	maxLeafCerts = 1000
+)
+
+// CertAuthority signs leaf certificates for the proxy listener and for
+// intercepted CONNECT tunnels, caching up to maxLeafCerts of them by
+// hostname. A CertAuthority
+// loaded from a directory keeps its root there, and replaces it when Renew
+// finds it close to expiry.
+type CertAuthority struct {
+	Dir string
+
+	mu       sync.Mutex
+	root     *tls.Certificate
+	leafs    map[string]*list.Element // Of *leafCert, in leafList
+	leafList list.List                // Most recently used first
+}
+
+type leafCert struct {
+	host string
+	cert *tls.Certificate
+}
+
+func NewCertAuthority() (*CertAuthority, error) {
+	cert, err := makeCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertAuthority{root: cert}, nil
+}
+
+func LoadCertAuthority(dir string) (*CertAuthority, error) {
+	var ca = CertAuthority{Dir: dir}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	switch {
+	case err == nil:
+		ca.root = &cert
+
+	case errors.Is(err, fs.ErrNotExist):
+
+	default:
+		return nil, fmt.Errorf("load CA %s: %w", dir, err)
+	}
+
+	if _, err := ca.Renew(); err != nil {
+		return nil, err
+	}
+
+	return &ca, nil
+}
+
+func (ca *CertAuthority) Root() *tls.Certificate {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	return ca.root
+}
+
+func (ca *CertAuthority) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Root().Certificate[0]})
+}
+
+// Renew replaces the root certificate if it is missing or will expire within
+// caCertRenew, reporting whether it did so.
+func (ca *CertAuthority) Renew() (bool, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if root := ca.root; root != nil && time.Until(root.Leaf.NotAfter) > caCertRenew {
+		return false, nil
+	}
+
+	cert, err := makeCertificate()
+	if err != nil {
+		return false, err
+	}
+
+	if dir := ca.Dir; dir != "" {
+		if err := saveCertificate(dir, cert); err != nil {
+			return false, err
+		}
+	}
+
+	ca.root = cert
+	ca.leafs = nil
+	ca.leafList.Init()
+
+	return true, nil
+}
+
+func saveCertificate(dir string, cert *tls.Certificate) error {
+	if err := mkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var (
+		certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+		keyPem  = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	)
+
+	if err := writeFileAtomic(filepath.Join(dir, caKeyFile), keyPem, 0o600); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, caCertFile), certPem, 0o644)
+}
+
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (ca *CertAuthority) Certificate(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if e, ok := ca.leafs[host]; ok {
+		if leaf := e.Value.(*leafCert).cert; time.Until(leaf.Leaf.NotAfter) > leafCertRenew {
+			ca.leafList.MoveToFront(e)
+			return leaf, nil
+		}
+		ca.leafList.Remove(e)
+		delete(ca.leafs, host)
+	}
+
+	leaf, err := makeLeafCertificate(ca.root, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca.leafs == nil {
+		ca.leafs = make(map[string]*list.Element)
+	}
+	ca.leafs[host] = ca.leafList.PushFront(&leafCert{host, leaf})
+
+	for ca.leafList.Len() > maxLeafCerts {
+		e := ca.leafList.Back()
+		ca.leafList.Remove(e)
+		delete(ca.leafs, e.Value.(*leafCert).host)
+	}
+
+	return leaf, nil
+}
+
+func makeCertificate() (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now      = time.Now()
+		template = &x509.Certificate{
+			Subject: pkix.Name{
+				Organization:       []string{"go.pdmccormick.com"},
+				OrganizationalUnit: []string{"chromekiosk"},
+				CommonName:         "proxy",
+			},
+
+			NotBefore: now.AddDate(0, -1, 0),
+			NotAfter:  now.Add(caCertValidity),
+
+			KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+	)
+
+	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsCert = tls.Certificate{
+		Certificate: [][]byte{certDer},
+		PrivateKey:  priv,
+		Leaf:        cert,
+	}
+
+	return &tlsCert, nil
+}
+
+func makeLeafCertificate(ca *tls.Certificate, host string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		now      = time.Now()
+		template = &x509.Certificate{
+			Subject: pkix.Name{
+				Organization:       []string{"go.pdmccormick.com"},
+				OrganizationalUnit: []string{"chromekiosk"},
+				CommonName:         host,
+			},
+
+			NotBefore: now.Add(-time.Hour),
+			NotAfter:  now.Add(leafCertValidity),
+
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+			BasicConstraintsValid: true,
+		}
+	)
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	if notAfter := ca.Leaf.NotAfter; template.NotAfter.After(notAfter) {
+		template.NotAfter = notAfter
+	}
+
+	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, ca.Leaf, priv.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsCert = tls.Certificate{
+		Certificate: [][]byte{certDer, ca.Certificate[0]},
+		PrivateKey:  priv,
+		Leaf:        cert,
+	}
+
+	return &tlsCert, nil
+}
@@ -6,9 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"go.pdmccormick.com/chromekiosk"
@@ -23,17 +26,280 @@ func main() {
 		rundirFlag = flag.String("rundir", "/run/chromekiosk", "`path` to rundir")
 		urlFlag    = flag.String("url", "blank:yellow", "starting url")
 		debugFlag  = flag.String("remotedebug", "127.0.0.1:9222", "`addr:port` for Chrome Remote Debugger")
+		policyFlag = flag.String("policy", "", "`path` to JSON proxy allow/deny policy")
+		hostsFlag  = flag.String("hosts", "", "`path` to hosts-like file mapping proxied hostnames to local targets")
+		dnsFlag    = flag.String("dns", "", "`path` to JSON static DNS records and per-domain DNS servers for upstream connections")
+		contFlag   = flag.String("content", "", "comma separated `host=path` static content bundles (directory or zip) served by the proxy")
+		intFlag    = flag.String("internal", "", "`path` to JSON rules for Chrome background requests to block")
+		learnFlag  = flag.Bool("learninternal", false, "record unknown requests made while no page is loading for /learned")
+		thrFlag    = flag.String("throttle", "", "`path` to JSON proxy throttle rules, enabled at startup and toggled with /throttle")
+		jarFlag    = flag.Bool("cookiejar", false, "keep upstream cookies in the proxy, saved in rundir across Chrome profile resets")
+		seedFlag   = flag.String("cookies", "", "`path` to JSON cookies seeded into the proxy cookie jar (implies -cookiejar)")
+		credsFlag  = flag.String("credentials", "", "`path` to JSON per-host upstream credentials and client certificates")
+		tlsFlag    = flag.String("upstreamtls", "", "`path` to JSON upstream TLS policy: extra root CAs, pins, insecure hosts and minimum versions")
+		interFlag  = flag.Bool("intercept", false, "intercept and decrypt HTTPS traffic in the proxy")
+		cacheFlag  = flag.Int64("cache", 0, "size in `MB` of the proxy disk cache (0 to disable)")
+		pinFlag    = flag.String("cachepin", "", "comma separated host `patterns` never evicted from the cache")
+		errorFlag  = flag.String("errorpage", "", "`path` to HTML template for upstream error pages")
+		logoFlag   = flag.String("errorlogo", "", "logo image `file` shown on upstream error pages")
+		harFlag    = flag.Int("har", 0, "record the last `N` proxied requests for /har")
+		harBody    = flag.Int64("harbody", 0, "record up to `bytes` of each request and response body for /har")
+		viaFlag    = flag.String("via", "", "add Via headers with proxy `pseudonym`")
+		xffFlag    = flag.Bool("xff", false, "add client addresses to X-Forwarded-For")
+		upFlag     = flag.String("upstreamproxy", "", "send upstream traffic through proxy `url` (http://, https:// or socks5://)")
+		socksFlag  = flag.Bool("socks", false, "also send Chrome's non-HTTP traffic through a SOCKS5 listener on the proxy")
+		noProxy    = flag.String("noproxy", "", "comma separated `hosts` not sent through -upstreamproxy")
+		jsonFlag   = flag.Bool("logjson", false, "log as JSON rather than text")
+		levelFlag  = flag.String("loglevel", "info", "minimum `level` logged: debug, info, warn or error")
 	)
 	flag.Parse()
 
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*levelFlag)); err != nil {
+		log.Fatalf("bad -loglevel: %s", err)
+	}
+
+	var (
+		opts    = &slog.HandlerOptions{Level: level}
+		handler slog.Handler
+	)
+
+	if *jsonFlag {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+
+	// net/http reads this from the environment as it starts, and neither
+	// //go:debug nor go.mod accept it.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		logger.Info("WebSockets over HTTP/2 need GODEBUG=http2xconnect=1, using HTTP/1.1")
+	}
+
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
+	var proxy = &chromekiosk.DefaultProxyHandler
+
+	proxy.Logger = logger
+
+	if *jarFlag || *seedFlag != "" {
+		proxy.Cookies = &chromekiosk.CookieJar{
+			File:   filepath.Join(*rundirFlag, "cookies.json"),
+			Logger: logger,
+		}
+	}
+
+	contentPaths := make(map[string]string)
+	if s := *contFlag; s != "" {
+		proxy.Content = make(map[string]*chromekiosk.ContentBundle)
+
+		for _, spec := range strings.Split(s, ",") {
+			host, name, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Fatalf("bad -content %q, expected host=path", spec)
+			}
+
+			host = strings.ToLower(host)
+			contentPaths[host] = name
+			proxy.Content[host] = new(chromekiosk.ContentBundle)
+		}
+	}
+
+	// reload (re)reads the proxy configuration files that can be swapped at
+	// runtime. Every file is read before any is applied, so that a bad one
+	// leaves the running configuration as it was.
+	reload := func() (err error) {
+		var (
+			policy   *chromekiosk.Policy
+			hosts    *chromekiosk.HostTable
+			resolver *chromekiosk.Resolver
+			internal *chromekiosk.InternalRequestMatcher
+			throttle *chromekiosk.Throttle
+			seeds    []chromekiosk.CookieSeed
+			creds    *chromekiosk.Credentials
+			upTLS    *chromekiosk.UpstreamTLS
+			bundles  = make(map[string]*chromekiosk.ContentBundle)
+		)
+
+		defer func() {
+			if err != nil {
+				for _, b := range bundles {
+					b.Close()
+				}
+			}
+		}()
+
+		if name := *policyFlag; name != "" {
+			if policy, err = chromekiosk.ReadPolicyFile(name); err != nil {
+				return fmt.Errorf("ReadPolicyFile: %w", err)
+			}
+		}
+
+		if name := *hostsFlag; name != "" {
+			if hosts, err = chromekiosk.ReadHostsFile(name); err != nil {
+				return fmt.Errorf("ReadHostsFile: %w", err)
+			}
+		}
+
+		if name := *dnsFlag; name != "" {
+			if resolver, err = chromekiosk.ReadResolverFile(name); err != nil {
+				return fmt.Errorf("ReadResolverFile: %w", err)
+			}
+		}
+
+		if name := *intFlag; name != "" {
+			if internal, err = chromekiosk.ReadInternalRequestsFile(name); err != nil {
+				return fmt.Errorf("ReadInternalRequestsFile: %w", err)
+			}
+		}
+
+		if name := *thrFlag; name != "" {
+			if throttle, err = chromekiosk.ReadThrottleFile(name); err != nil {
+				return fmt.Errorf("ReadThrottleFile: %w", err)
+			}
+		}
+
+		if name := *seedFlag; name != "" {
+			if seeds, err = chromekiosk.ReadCookieSeedsFile(name); err != nil {
+				return fmt.Errorf("ReadCookieSeedsFile: %w", err)
+			}
+		}
+
+		if name := *credsFlag; name != "" {
+			if creds, err = chromekiosk.ReadCredentialsFile(name); err != nil {
+				return fmt.Errorf("ReadCredentialsFile: %w", err)
+			}
+		}
+
+		if name := *tlsFlag; name != "" {
+			if upTLS, err = chromekiosk.ReadUpstreamTLSFile(name); err != nil {
+				return fmt.Errorf("ReadUpstreamTLSFile: %w", err)
+			}
+		}
+
+		for host, name := range contentPaths {
+			b, err := chromekiosk.OpenContentBundle(name)
+			if err != nil {
+				return fmt.Errorf("content %s: %w", host, err)
+			}
+			bundles[host] = b
+		}
+
+		// These can still fail, on a bad TLS rule or a missing cookie
+		// secret, so they go first.
+		if upTLS != nil {
+			if err := proxy.SetUpstreamTLS(upTLS); err != nil {
+				return err
+			}
+		}
+
+		if seeds != nil {
+			if err := proxy.Cookies.Seed(seeds); err != nil {
+				return fmt.Errorf("cookies %s: %w", *seedFlag, err)
+			}
+		}
+
+		if policy != nil {
+			proxy.SetPolicy(policy)
+		}
+
+		if hosts != nil {
+			proxy.SetHosts(hosts)
+		}
+
+		if resolver != nil {
+			proxy.SetResolver(resolver)
+		}
+
+		if internal != nil {
+			proxy.SetInternalRequests(internal)
+		}
+
+		if throttle != nil {
+			proxy.SetThrottle(throttle)
+		}
+
+		if creds != nil {
+			proxy.SetCredentials(creds)
+		}
+
+		for host, b := range bundles {
+			proxy.Content[host].Replace(b)
+		}
+
+		return nil
+	}
+
+	if err := reload(); err != nil {
+		log.Fatal(err)
+	}
+
+	proxy.Intercept = *interFlag
+	proxy.Via = *viaFlag
+	proxy.ForwardedFor = *xffFlag
+
+	proxy.SetThrottling(*thrFlag != "")
+
+	if *learnFlag {
+		proxy.LearnInternal = &chromekiosk.InternalRequestLearner{}
+	}
+
+	if name := *logoFlag; name != "" {
+		logo, err := chromekiosk.LoadErrorLogo(name)
+		if err != nil {
+			log.Fatalf("LoadErrorLogo: %s", err)
+		}
+
+		proxy.ErrorLogo = logo
+	}
+
+	if name := *errorFlag; name != "" {
+		tmpl, err := chromekiosk.LoadErrorPageTemplate(name)
+		if err != nil {
+			log.Fatalf("LoadErrorPageTemplate: %s", err)
+		}
+
+		proxy.ErrorPage = tmpl
+	}
+
+	if size := *cacheFlag; size > 0 {
+		proxy.Cache = &chromekiosk.Cache{
+			MaxBytes: size << 20,
+		}
+
+		if pins := *pinFlag; pins != "" {
+			proxy.Cache.Pinned = strings.Split(pins, ",")
+		}
+	}
+
+	if n := *harFlag; n > 0 {
+		proxy.HAR = &chromekiosk.HARRecorder{
+			Size:        n,
+			MaxBodySize: *harBody,
+		}
+	}
+
+	if u := *upFlag; u != "" {
+		up, err := chromekiosk.ParseUpstreamProxy(u, *noProxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		proxy.Upstream = up
+	}
+
 	var m = chromekiosk.Monitor{
-		StartUrl:   *urlFlag,
-		ImagePath:  *imageFlag,
-		MountPoint: *mountFlag,
-		RunDir:     *rundirFlag,
+		ProxyHandler: proxy,
+		SOCKSProxy:   *socksFlag,
+		StartUrl:     *urlFlag,
+		ImagePath:    *imageFlag,
+		MountPoint:   *mountFlag,
+		RunDir:       *rundirFlag,
+		Logger:       logger,
 	}
 
 	if err := m.Init(); err != nil {
@@ -78,6 +344,97 @@ func main() {
 		}
 	})
 
+	mux.Handle("/metrics", chromekiosk.DefaultMetrics)
+
+	mux.HandleFunc("/har", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.HAR == nil {
+			http.Error(w, "HAR recording disabled, see -har", http.StatusNotFound)
+			return
+		}
+
+		reset := r.URL.Query().Get("reset") == "1"
+		if reset && !requirePost(w, r) {
+			return
+		}
+
+		proxy.HAR.ServeHTTP(w, r)
+
+		if reset {
+			proxy.HAR.Reset()
+		}
+	})
+
+	mux.HandleFunc("/learned", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.LearnInternal == nil {
+			http.Error(w, "learning disabled, see -learninternal", http.StatusNotFound)
+			return
+		}
+
+		reset := r.URL.Query().Get("reset") == "1"
+		if reset && !requirePost(w, r) {
+			return
+		}
+
+		proxy.LearnInternal.ServeHTTP(w, r)
+
+		if reset {
+			proxy.LearnInternal.Reset()
+		}
+	})
+
+	mux.HandleFunc("/cookies", func(w http.ResponseWriter, r *http.Request) {
+		if proxy.Cookies == nil {
+			http.Error(w, "cookie jar disabled, see -cookiejar", http.StatusNotFound)
+			return
+		}
+
+		if qs := r.URL.Query(); qs.Get("clear") == "1" {
+			if !requirePost(w, r) {
+				return
+			}
+
+			if _, err := proxy.Cookies.Clear(qs.Get("domain")); err != nil {
+				log.Printf("cookies: %s", err)
+			}
+		}
+
+		proxy.Cookies.ServeHTTP(w, r)
+	})
+
+	mux.HandleFunc("/throttle", func(w http.ResponseWriter, r *http.Request) {
+		enable := r.URL.Query().Get("enable")
+		if enable != "" && !requirePost(w, r) {
+			return
+		}
+
+		switch enable {
+		case "1", "true":
+			proxy.SetThrottling(true)
+		case "0", "false":
+			proxy.SetThrottling(false)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Enabled  bool                  `json:"enabled"`
+			Throttle *chromekiosk.Throttle `json:"throttle"`
+		}{proxy.Throttling(), proxy.Throttle()})
+	})
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r) {
+			return
+		}
+
+		if err := reload(); err != nil {
+			log.Printf("reload: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintf(w, "reloaded\n")
+	})
+
 	mux.HandleFunc("/quit", func(w http.ResponseWriter, r *http.Request) {
 		qs := r.URL.Query()
 		if now := qs.Get("now"); now == "1" {
@@ -121,4 +478,22 @@ RunLoop:
 	}
 
 	wg.Wait()
+
+	if proxy.Cookies != nil {
+		if err := proxy.Cookies.Save(); err != nil {
+			log.Printf("cookies: %s", err)
+		}
+	}
+}
+
+// requirePost rejects requests that would change state unless they are
+// POSTs, so that a stray GET, such as a prefetch, cannot.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, r.URL.Path+" with these parameters requires POST", http.StatusMethodNotAllowed)
+	return false
 }
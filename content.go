@@ -0,0 +1,306 @@
+package chromekiosk
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentBundle serves a tree of static files, from a directory, a zip
+// file or any fs.FS, as a virtual host of a Proxy; see Proxy.Content. The
+// tree can be swapped atomically while requests are being served.
+type ContentBundle struct {
+	current atomic.Pointer[contentFS]
+}
+
+// contentFS is one generation of a bundle, closed once it has been
+// replaced and the last request using it has finished.
+type contentFS struct {
+	fsys      fs.FS
+	closer    io.Closer
+	refs      atomic.Int64
+	retired   atomic.Bool
+	closeOnce sync.Once
+
+	// For a zip file, the archive and its entries by name; stored entries
+	// are served straight from the archive, and compressed ones from
+	// memory once they have been decompressed.
+	zipFile  io.ReaderAt
+	zipFiles map[string]*zip.File
+
+	inflatedMu   sync.Mutex
+	inflated     map[string][]byte
+	inflatedSize int64
+}
+
+// Decompressed zip entries are kept in memory up to this many bytes.
+const maxInflatedSize = 64 << 20
+
+// Extra content types for kiosk media, which the system MIME tables may be
+// missing.
+var contentTypes = map[string]string{
+	".m4a":   "audio/mp4",
+	".m4v":   "video/mp4",
+	".mp3":   "audio/mpeg",
+	".mp4":   "video/mp4",
+	".oga":   "audio/ogg",
+	".ogg":   "audio/ogg",
+	".ogv":   "video/ogg",
+	".opus":  "audio/ogg",
+	".vtt":   "text/vtt; charset=utf-8",
+	".webm":  "video/webm",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+func NewContentBundle(fsys fs.FS) *ContentBundle {
+	var b ContentBundle
+	b.Set(fsys)
+	return &b
+}
+
+// OpenContentBundle opens a bundle from a directory or a zip file.
+func OpenContentBundle(name string) (*ContentBundle, error) {
+	var b ContentBundle
+	if err := b.Load(name); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Set atomically replaces the bundle contents.
+func (b *ContentBundle) Set(fsys fs.FS) { b.swap(&contentFS{fsys: fsys}) }
+
+// Load atomically replaces the bundle contents with a directory or a zip
+// file.
+func (b *ContentBundle) Load(name string) error {
+	cf, err := openContent(name)
+	if err != nil {
+		return err
+	}
+
+	b.swap(cf)
+	return nil
+}
+
+// Replace atomically gives b the contents of nb, such as a bundle from
+// OpenContentBundle, which must not be used afterwards.
+func (b *ContentBundle) Replace(nb *ContentBundle) { b.swap(nb.current.Swap(nil)) }
+
+// Close releases the bundle contents once requests using them finish.
+func (b *ContentBundle) Close() { b.swap(nil) }
+
+func openContent(name string) (*contentFS, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &contentFS{fsys: os.DirFS(name)}, nil
+	}
+
+	if !strings.EqualFold(filepath.Ext(name), ".zip") {
+		return nil, fmt.Errorf("content %s: not a directory or zip file", name)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("content %s: %w", name, err)
+	}
+
+	cf := &contentFS{
+		fsys:     zr,
+		closer:   f,
+		zipFile:  f,
+		zipFiles: make(map[string]*zip.File),
+	}
+
+	for _, zf := range zr.File {
+		cf.zipFiles[zf.Name] = zf
+	}
+
+	return cf, nil
+}
+
+func (b *ContentBundle) swap(cf *contentFS) {
+	if old := b.current.Swap(cf); old != nil {
+		old.retired.Store(true)
+		if old.refs.Load() == 0 {
+			old.close()
+		}
+	}
+}
+
+// acquire returns the current generation, which stays open until release.
+func (b *ContentBundle) acquire() *contentFS {
+	for {
+		cf := b.current.Load()
+		if cf == nil {
+			return nil
+		}
+
+		cf.refs.Add(1)
+		if b.current.Load() == cf {
+			return cf
+		}
+		cf.release()
+	}
+}
+
+func (cf *contentFS) release() {
+	if cf.refs.Add(-1) == 0 && cf.retired.Load() {
+		cf.close()
+	}
+}
+
+func (cf *contentFS) close() {
+	cf.closeOnce.Do(func() {
+		if cf.closer != nil {
+			cf.closer.Close()
+		}
+	})
+}
+
+func (b *ContentBundle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cf := b.acquire()
+	if cf == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer cf.release()
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, fi, err := openContentFile(cf.fsys, name)
+	if err == nil && fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+			f.Close()
+			return
+		}
+
+		f.Close()
+		name = path.Join(name, "index.html")
+		f, fi, err = openContentFile(cf.fsys, name)
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+
+	content, err := cf.content(name, f)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("ETag", contentETag(fi))
+
+	ext := strings.ToLower(path.Ext(fi.Name()))
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		hdr.Set("Content-Type", ctype)
+	} else if ctype, ok := contentTypes[ext]; ok {
+		hdr.Set("Content-Type", ctype)
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
+
+// content returns f, the file called name, as an io.ReadSeeker for
+// http.ServeContent.
+func (cf *contentFS) content(name string, f fs.File) (io.ReadSeeker, error) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+
+	zf := cf.zipFiles[name]
+
+	if zf != nil && zf.Method == zip.Store {
+		if off, err := zf.DataOffset(); err == nil {
+			return io.NewSectionReader(cf.zipFile, off, int64(zf.UncompressedSize64)), nil
+		}
+	}
+
+	cf.inflatedMu.Lock()
+	data, ok := cf.inflated[name]
+	cf.inflatedMu.Unlock()
+
+	if ok {
+		return bytes.NewReader(data), nil
+	}
+
+	// Anything else that cannot seek is read into memory.
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if zf != nil {
+		cf.inflatedMu.Lock()
+		if _, ok := cf.inflated[name]; !ok && cf.inflatedSize+int64(len(data)) <= maxInflatedSize {
+			if cf.inflated == nil {
+				cf.inflated = make(map[string][]byte)
+			}
+			cf.inflated[name] = data
+			cf.inflatedSize += int64(len(data))
+		}
+		cf.inflatedMu.Unlock()
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func openContentFile(fsys fs.FS, name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, fi, nil
+}
+
+func contentETag(fi fs.FileInfo) string {
+	if zf, ok := fi.Sys().(*zip.FileHeader); ok {
+		return fmt.Sprintf(`"%x-%x"`, zf.CRC32, zf.UncompressedSize64)
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
@@ -0,0 +1,99 @@
+package chromekiosk
+
+import (
+	"archive/zip"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestContentBundle(t *testing.T) {
+	bundle := NewContentBundle(fstest.MapFS{
+		"index.html":     {Data: []byte("<html>v1</html>")},
+		"media/clip.mp4": {Data: []byte("0123456789")},
+	})
+
+	var pr = Proxy{
+		Content: map[string]*ContentBundle{"content.kiosk.localhost": bundle},
+	}
+
+	get := func(path string, hdr ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://content.kiosk.localhost"+path, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			r.Header.Set(hdr[i], hdr[i+1])
+		}
+
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/")
+	if w.Code != http.StatusOK || w.Body.String() != "<html>v1</html>" || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("index: got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	w = get("/media/clip.mp4", "Range", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("range: got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	etag := w.Header().Get("ETag")
+	if w = get("/media/clip.mp4", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match %s: got %d", etag, w.Code)
+	}
+
+	if w = get("/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing: got %d", w.Code)
+	}
+
+	name := filepath.Join(t.TempDir(), "content.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zw := zip.NewWriter(f)
+	fw, _ := zw.Create("index.html")
+	fw.Write([]byte("<html>v2</html>"))
+	fw, _ = zw.CreateHeader(&zip.FileHeader{Name: "media/clip.mp4", Method: zip.Store})
+	fw.Write([]byte("0123456789"))
+	zw.Close()
+	f.Close()
+
+	if err := bundle.Load(name); err != nil {
+		t.Fatal(err)
+	}
+
+	w = get("/")
+	if w.Body.String() != "<html>v2</html>" || w.Header().Get("ETag") == "" {
+		t.Errorf("swapped zip: got %d %q", w.Code, w.Body)
+	}
+
+	if w = get("/", "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("zip If-None-Match: got %d", w.Code)
+	}
+
+	// Stored entries are read in place, and deflated ones decompressed once.
+	w = get("/media/clip.mp4", "Range", "bytes=7-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" {
+		t.Errorf("zip range: got %d %q", w.Code, w.Body)
+	}
+
+	cf := bundle.acquire()
+	defer cf.release()
+
+	if _, ok := cf.inflated["media/clip.mp4"]; ok || len(cf.inflated) != 1 {
+		t.Errorf("inflated entries: %v", slices.Collect(maps.Keys(cf.inflated)))
+	}
+	bundle.Replace(NewContentBundle(fstest.MapFS{"index.html": {Data: []byte("<html>v3</html>")}}))
+
+	if w = get("/"); w.Body.String() != "<html>v3</html>" {
+		t.Errorf("replaced: got %d %q", w.Code, w.Body)
+	}
+}
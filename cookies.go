@@ -0,0 +1,473 @@
+package chromekiosk
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieJar keeps cookies on Chrome's behalf. Cookies in the jar for a
+// request's URL are added to it, unless Chrome sent one of the same name,
+// and those set by upstream responses are captured, as well as passed on.
+// If File is set the jar is saved there, so that sessions survive resets of
+// the Chrome profile. HTTPS requests are only seen when intercepted.
+type CookieJar struct {
+	File string
+
+	// Logger receives errors loading and saving File; if nil, slog.Default().
+	Logger *slog.Logger
+
+	loadOnce  sync.Once
+	mu        sync.Mutex
+	cookies   map[cookieKey]*JarCookie
+	saveTimer *time.Timer
+	saveMu    sync.Mutex
+	noSave    error // Why File must not be overwritten
+}
+
+type JarCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value,omitempty"`
+	Domain   string    `json:"domain"`
+	HostOnly bool      `json:"hostOnly,omitempty"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitzero"` // Zero for session cookies, which are kept
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"httpOnly,omitempty"`
+}
+
+type cookieKey struct{ domain, path, name string }
+
+// Captured cookies are saved after this delay, along with any others
+// captured meanwhile.
+const cookieSaveDelay = 5 * time.Second
+
+func (c *JarCookie) key() cookieKey { return cookieKey{c.Domain, c.Path, c.Name} }
+
+func (c *JarCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// CookieSeed is a cookie put in the jar from configuration, replacing any
+// captured one. It applies to Domain and its subdomains unless HostOnly.
+type CookieSeed struct {
+	Domain   string `json:"domain"`
+	Path     string `json:"path,omitempty"`
+	Name     string `json:"name"`
+	Value    Secret `json:"value"`
+	HostOnly bool   `json:"hostOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+}
+
+func ReadCookieSeedsFile(name string) ([]CookieSeed, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds []CookieSeed
+	if err := json.Unmarshal(data, &seeds); err != nil {
+		return nil, fmt.Errorf("cookies %s: %w", name, err)
+	}
+
+	return seeds, nil
+}
+
+// LoadCookiesFile seeds the cookie jar from a JSON list of CookieSeeds.
+func (pr *Proxy) LoadCookiesFile(name string) error {
+	if pr.Cookies == nil {
+		return fmt.Errorf("cookies %s: no cookie jar", name)
+	}
+
+	seeds, err := ReadCookieSeedsFile(name)
+	if err != nil {
+		return err
+	}
+
+	if err := pr.Cookies.Seed(seeds); err != nil {
+		return fmt.Errorf("cookies %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (j *CookieJar) load() {
+	j.cookies = make(map[cookieKey]*JarCookie)
+
+	if j.File == "" {
+		return
+	}
+
+	data, err := os.ReadFile(j.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		j.noSave = fmt.Errorf("cookie jar %s not loaded: %w", j.File, err)
+		j.logger().Error("cookie jar not loaded, and will not be saved", "file", j.File, "err", err)
+		return
+	}
+
+	var cookies []*JarCookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		// Keep the file for inspection, rather than overwrite it.
+		bad := j.File + ".bad"
+		if rerr := os.Rename(j.File, bad); rerr != nil {
+			j.noSave = fmt.Errorf("cookie jar %s not loaded: %w", j.File, err)
+			j.logger().Error("cookie jar not loaded, and will not be saved", "file", j.File, "err", errors.Join(err, rerr))
+			return
+		}
+
+		j.logger().Error("cookie jar not loaded, moved aside", "file", j.File, "moved", bad, "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, c := range cookies {
+		if !c.expired(now) {
+			j.cookies[c.key()] = c
+		}
+	}
+}
+
+// Save writes the jar to File, if set, including changes waiting to be
+// saved.
+func (j *CookieJar) Save() error {
+	if j.File == "" {
+		return nil
+	}
+
+	j.loadOnce.Do(j.load)
+
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+
+	j.mu.Lock()
+	if j.saveTimer != nil {
+		j.saveTimer.Stop()
+		j.saveTimer = nil
+	}
+	data, err := json.MarshalIndent(j.listLocked(""), "", "\t")
+	j.mu.Unlock()
+
+	switch {
+	case j.noSave != nil:
+		return j.noSave
+	case err != nil:
+		return err
+	}
+
+	if err := mkdirAll(filepath.Dir(j.File), 0o775); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(j.File, data, 0o600)
+}
+
+// saveLaterLocked saves the jar after cookieSaveDelay, off the request
+// path, with j.mu held.
+func (j *CookieJar) saveLaterLocked() {
+	if j.File == "" || j.saveTimer != nil {
+		return
+	}
+
+	j.saveTimer = time.AfterFunc(cookieSaveDelay, func() {
+		if err := j.Save(); err != nil {
+			j.logger().Warn("cookie jar save", "file", j.File, "err", err)
+		}
+	})
+}
+
+func (j *CookieJar) logger() *slog.Logger {
+	return cmp.Or(j.Logger, slog.Default()).With("component", "proxy")
+}
+
+func (j *CookieJar) Seed(seeds []CookieSeed) error {
+	j.loadOnce.Do(j.load)
+
+	var cookies []*JarCookie
+	for _, seed := range seeds {
+		value, err := seed.Value.resolve()
+		if err != nil {
+			return fmt.Errorf("cookie %s: %w", seed.Name, err)
+		}
+
+		c := &JarCookie{
+			Name:     seed.Name,
+			Value:    value,
+			Domain:   canonicalHostname(strings.TrimPrefix(seed.Domain, ".")),
+			HostOnly: seed.HostOnly,
+			Path:     seed.Path,
+			Secure:   seed.Secure,
+			HttpOnly: seed.HttpOnly,
+		}
+
+		if c.Name == "" || c.Domain == "" {
+			return fmt.Errorf("cookie %q: missing name or domain", seed.Name)
+		}
+
+		if c.Path == "" {
+			c.Path = "/"
+		}
+
+		cookies = append(cookies, c)
+	}
+
+	j.mu.Lock()
+	for _, c := range cookies {
+		j.cookies[c.key()] = c
+	}
+	j.mu.Unlock()
+
+	return j.Save()
+}
+
+// List returns the cookies for domain and its subdomains, or all cookies
+// if domain is empty.
+func (j *CookieJar) List(domain string) []JarCookie {
+	j.loadOnce.Do(j.load)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var cookies []JarCookie
+	for _, c := range j.listLocked(domain) {
+		cookies = append(cookies, *c)
+	}
+	return cookies
+}
+
+func (j *CookieJar) listLocked(domain string) []*JarCookie {
+	var (
+		cookies []*JarCookie
+		now     = time.Now()
+	)
+
+	domain = canonicalHostname(strings.TrimPrefix(domain, "."))
+
+	for _, c := range j.cookies {
+		if !c.expired(now) && (domain == "" || domainMatch(c.Domain, domain)) {
+			cookies = append(cookies, c)
+		}
+	}
+
+	slices.SortFunc(cookies, func(a, b *JarCookie) int {
+		return strings.Compare(a.Domain+a.Path+a.Name, b.Domain+b.Path+b.Name)
+	})
+
+	return cookies
+}
+
+// Clear removes the cookies for domain and its subdomains, or all cookies
+// if domain is empty, and returns how many were removed.
+func (j *CookieJar) Clear(domain string) (int, error) {
+	j.loadOnce.Do(j.load)
+
+	j.mu.Lock()
+	cookies := j.listLocked(domain)
+	for _, c := range cookies {
+		delete(j.cookies, c.key())
+	}
+	j.mu.Unlock()
+
+	return len(cookies), j.Save()
+}
+
+// ServeHTTP lists the cookies as JSON, for the domain given by ?domain=.
+// Their values, which are often session tokens, are left out.
+func (j *CookieJar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cookies := j.List(r.URL.Query().Get("domain"))
+	if cookies == nil {
+		cookies = []JarCookie{}
+	}
+
+	for i := range cookies {
+		cookies[i].Value = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cookies)
+}
+
+// domainMatch reports whether host is domain or one of its subdomains.
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// isPublicSuffix reports whether domain is a public suffix, under which
+// anyone may register names, so that no cookie may be set for it.
+func isPublicSuffix(domain string) bool {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return suffix == domain
+}
+
+// matches reports whether c is sent with requests for u, as in RFC 6265,
+// section 5.4.
+func (c *JarCookie) matches(u *url.URL, host string) bool {
+	if c.HostOnly && host != c.Domain || !domainMatch(host, c.Domain) {
+		return false
+	}
+
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+
+	return p == c.Path ||
+		strings.HasPrefix(p, c.Path) && (strings.HasSuffix(c.Path, "/") || p[len(c.Path)] == '/')
+}
+
+// matching returns the jar's cookies for req's URL that Chrome did not send
+// itself.
+func (j *CookieJar) matching(req *http.Request) []*JarCookie {
+	j.loadOnce.Do(j.load)
+
+	var (
+		host    = canonicalHostname(req.URL.Hostname())
+		sent    = make(map[string]bool)
+		now     = time.Now()
+		cookies []*JarCookie
+	)
+
+	for _, c := range req.Cookies() {
+		sent[c.Name] = true
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, c := range j.cookies {
+		if !sent[c.Name] && !c.expired(now) && c.matches(req.URL, host) {
+			cookies = append(cookies, c)
+		}
+	}
+
+	return cookies
+}
+
+// addCookies returns req with the jar's cookies for its URL added.
+func (j *CookieJar) addCookies(req *http.Request) *http.Request {
+	cookies := j.matching(req)
+	if len(cookies) == 0 {
+		return req
+	}
+
+	var pairs []string
+
+	// Longer paths first, as browsers send them.
+	slices.SortStableFunc(cookies, func(a, b *JarCookie) int { return len(b.Path) - len(a.Path) })
+
+	if prior := req.Header.Values("Cookie"); len(prior) > 0 {
+		pairs = append(pairs, strings.Join(prior, "; "))
+	}
+
+	for _, c := range cookies {
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Cookie", strings.Join(pairs, "; "))
+	return req
+}
+
+// capture stores the cookies set by resp, a response for u.
+func (j *CookieJar) capture(u *url.URL, resp *http.Response) {
+	setCookies := resp.Cookies()
+	if len(setCookies) == 0 {
+		return
+	}
+
+	j.loadOnce.Do(j.load)
+
+	var (
+		host    = canonicalHostname(u.Hostname())
+		now     = time.Now()
+		changed bool
+	)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, sc := range setCookies {
+		c := &JarCookie{
+			Name:     sc.Name,
+			Value:    sc.Value,
+			Domain:   host,
+			HostOnly: true,
+			Path:     sc.Path,
+			Secure:   sc.Secure,
+			HttpOnly: sc.HttpOnly,
+		}
+
+		if d := canonicalHostname(strings.TrimPrefix(sc.Domain, ".")); d != "" && d != host {
+			// Domain cookies must cover the host, and not be for a public
+			// suffix such as co.uk or an IP address.
+			if !domainMatch(host, d) || isPublicSuffix(d) || net.ParseIP(host) != nil {
+				continue
+			}
+			c.Domain, c.HostOnly = d, false
+		} else if d != "" {
+			c.HostOnly = false
+		}
+
+		if c.Secure && u.Scheme != "https" {
+			continue
+		}
+
+		if !strings.HasPrefix(c.Path, "/") {
+			c.Path = defaultCookiePath(u)
+		}
+
+		switch {
+		case sc.MaxAge < 0:
+			c.Expires = now
+		case sc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(sc.MaxAge) * time.Second)
+		default:
+			c.Expires = sc.Expires
+		}
+
+		if c.expired(now) {
+			if _, ok := j.cookies[c.key()]; ok {
+				delete(j.cookies, c.key())
+				changed = true
+			}
+			continue
+		}
+
+		j.cookies[c.key()] = c
+		changed = true
+	}
+
+	if changed {
+		j.saveLaterLocked()
+	}
+}
+
+// defaultCookiePath is as in RFC 6265, section 5.1.4.
+func defaultCookiePath(u *url.URL) string {
+	p := u.EscapedPath()
+	if !strings.HasPrefix(p, "/") || strings.Count(p, "/") == 1 {
+		return "/"
+	}
+	return path.Dir(p)
+}
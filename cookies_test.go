@@ -0,0 +1,160 @@
+package chromekiosk
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxyCookieJar(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/", Domain: "kiosk.test"})
+			http.SetCookie(w, &http.Cookie{Name: "secure", Value: "x", Secure: true})
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "session", Path: "/", Domain: "kiosk.test", MaxAge: -1})
+		}
+		w.Header().Set("X-Seen-Cookie", r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+
+	var (
+		dir       = t.TempDir()
+		jarFile   = filepath.Join(dir, "run", "cookies.json")
+		seedsFile = filepath.Join(dir, "cookies.json")
+	)
+
+	seeds := `[{"domain": "other.test", "name": "token", "value": {"value": "t1"}}]`
+	if err := os.WriteFile(seedsFile, []byte(seeds), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	newProxy := func() *Proxy {
+		return &Proxy{
+			HostMap: map[string]string{"*.test": "127.0.0.1"},
+			Cookies: &CookieJar{File: jarFile},
+		}
+	}
+
+	pr := newProxy()
+	if err := pr.LoadCookiesFile(seedsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	get := func(pr *Proxy, host, path, cookie string) string {
+		r := httptest.NewRequest("GET", "http://"+host+":"+port+path, nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w.Result().Header.Get("X-Seen-Cookie")
+	}
+
+	get(pr, "www.kiosk.test", "/login", "")
+
+	if got := get(pr, "dash.kiosk.test", "/", ""); got != "session=s1" {
+		t.Errorf("captured: got %q", got)
+	}
+
+	if got := get(pr, "other.test", "/", "token=chrome"); got != "token=chrome" {
+		t.Errorf("Chrome's cookie replaced: got %q", got)
+	}
+
+	// Captured cookies are saved later, or on shutdown.
+	if data, _ := os.ReadFile(jarFile); strings.Contains(string(data), "session") {
+		t.Errorf("saved on the request path: %s", data)
+	}
+
+	if err := pr.Cookies.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new jar loaded from the file, as after a restart.
+	pr = newProxy()
+
+	if got := get(pr, "sub.other.test", "/", "a=1"); got != "a=1; token=t1" {
+		t.Errorf("seeded: got %q", got)
+	}
+
+	if cookies := pr.Cookies.List("kiosk.test"); len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Errorf("List: got %+v", cookies)
+	}
+
+	get(pr, "www.kiosk.test", "/logout", "")
+
+	if got := get(pr, "www.kiosk.test", "/", ""); got != "" {
+		t.Errorf("after logout: got %q", got)
+	}
+
+	if n, err := pr.Cookies.Clear("other.test"); n != 1 || err != nil {
+		t.Errorf("Clear: got %d %v", n, err)
+	}
+
+	if cookies := newProxy().Cookies.List(""); len(cookies) != 0 {
+		t.Errorf("after Clear: got %+v", cookies)
+	}
+}
+
+func TestCookieJarFile(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		jarFile = filepath.Join(dir, "cookies.json")
+	)
+
+	if err := os.WriteFile(jarFile, []byte("[{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt file is moved aside, rather than overwritten.
+	j := CookieJar{File: jarFile, Logger: slog.New(slog.DiscardHandler)}
+	if err := j.Seed([]CookieSeed{{Domain: "kiosk.test", Name: "token", Value: Secret{Value: "t1"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(jarFile + ".bad"); err != nil || string(data) != "[{" {
+		t.Errorf("moved aside: got %q %v", data, err)
+	}
+
+	if cookies := (&CookieJar{File: jarFile}).List(""); len(cookies) != 1 || cookies[0].Value != "t1" {
+		t.Errorf("saved: got %+v", cookies)
+	}
+
+	// Values are not served.
+	w := httptest.NewRecorder()
+	j.ServeHTTP(w, httptest.NewRequest("GET", "/cookies", nil))
+
+	if body := w.Body.String(); strings.Contains(body, "t1") || !strings.Contains(body, "token") {
+		t.Errorf("served: got %s", body)
+	}
+}
+
+func TestCookieJarPublicSuffix(t *testing.T) {
+	var j CookieJar
+
+	u, _ := url.Parse("http://shop.example.co.uk/")
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {
+		"wide=1; Domain=co.uk",
+		"tld=1; Domain=uk",
+		"site=1; Domain=example.co.uk",
+	}}}
+	j.capture(u, resp)
+
+	var names []string
+	for _, c := range j.List("") {
+		names = append(names, c.Name)
+	}
+
+	if got := strings.Join(names, ","); got != "site" {
+		t.Errorf("captured: got %q", got)
+	}
+}
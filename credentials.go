@@ -0,0 +1,237 @@
+package chromekiosk
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Secret is given literally, read from a file, or taken from an
+// environment variable; exactly one of the fields should be set.
+type Secret struct {
+	Value string `json:"value,omitempty"`
+	File  string `json:"file,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+func (s *Secret) resolve() (string, error) {
+	switch {
+	case s.File != "":
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case s.Env != "":
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", s.Env)
+		}
+		return v, nil
+
+	default:
+		return s.Value, nil
+	}
+}
+
+// CredentialRule attaches credentials to upstream requests for hosts
+// matching Hosts (glob patterns, as in [PolicyRule]).
+//
+// ClientCert and ClientKey are PEM files of a client certificate chain and
+// its private key, presented when the proxy makes a TLS connection to the
+// host. ClientKey may be omitted if it is in the same file.
+type CredentialRule struct {
+	Hosts         []string          `json:"hosts"`
+	Bearer        *Secret           `json:"bearer,omitempty"`
+	BasicUser     string            `json:"basicUser,omitempty"`
+	BasicPassword *Secret           `json:"basicPassword,omitempty"`
+	Headers       map[string]Secret `json:"headers,omitempty"`
+	ClientCert    string            `json:"clientCert,omitempty"`
+	ClientKey     string            `json:"clientKey,omitempty"`
+}
+
+// Credentials is a resolved set of CredentialRules. Secrets are read once,
+// when it is created; client certificates are read again for new
+// connections once their files have changed.
+type Credentials struct {
+	rules []credentialSet
+}
+
+type credentialSet struct {
+	hosts  []string
+	header http.Header
+	cert   *clientCert
+}
+
+// clientCert is a client certificate key pair, and the modification times
+// of its files when it was loaded.
+type clientCert struct {
+	certFile, keyFile string
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+func NewCredentials(rules []CredentialRule) (*Credentials, error) {
+	var (
+		c    Credentials
+		errs []error
+	)
+
+	for i, rule := range rules {
+		var (
+			set  = credentialSet{hosts: rule.Hosts, header: make(http.Header)}
+			fail = func(what string, err error) {
+				errs = append(errs, fmt.Errorf("credential %d %s: %w", i, what, err))
+			}
+		)
+
+		if len(rule.Hosts) == 0 {
+			fail("hosts", errors.New("no hosts"))
+			continue
+		}
+
+		if s := rule.Bearer; s != nil {
+			token, err := s.resolve()
+			if err != nil {
+				fail("bearer", err)
+			}
+			set.header.Set("Authorization", "Bearer "+token)
+		}
+
+		if user := rule.BasicUser; user != "" {
+			var password string
+			if s := rule.BasicPassword; s != nil {
+				var err error
+				if password, err = s.resolve(); err != nil {
+					fail("basicPassword", err)
+				}
+			}
+
+			auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+			set.header.Set("Authorization", "Basic "+auth)
+		}
+
+		for k, s := range rule.Headers {
+			v, err := s.resolve()
+			if err != nil {
+				fail(k, err)
+			}
+			set.header.Set(k, v)
+		}
+
+		if name := rule.ClientCert; name != "" {
+			keyName := rule.ClientKey
+			if keyName == "" {
+				keyName = name
+			}
+
+			set.cert = &clientCert{certFile: name, keyFile: keyName}
+			if _, err := set.cert.get(); err != nil {
+				fail("clientCert", err)
+			}
+		}
+
+		c.rules = append(c.rules, set)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return &c, nil
+}
+
+func ReadCredentialsFile(name string) (*Credentials, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []CredentialRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("credentials %s: %w", name, err)
+	}
+
+	c, err := NewCredentials(rules)
+	if err != nil {
+		return nil, fmt.Errorf("credentials %s: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// header returns the headers to add for host, from the first matching rule.
+func (c *Credentials) header(host string) http.Header {
+	if c == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	for _, set := range c.rules {
+		if matchHostGlobs(set.hosts, host) {
+			return set.header
+		}
+	}
+	return nil
+}
+
+// certificate returns the client certificate for host, from the first
+// matching rule that has one.
+func (c *Credentials) certificate(host string) *clientCert {
+	if c == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	for _, set := range c.rules {
+		if set.cert != nil && matchHostGlobs(set.hosts, host) {
+			return set.cert
+		}
+	}
+	return nil
+}
+
+// get returns the key pair, reloading it if either file has been modified.
+// If that fails, the previous key pair is returned along with the error.
+func (cc *clientCert) get() (*tls.Certificate, error) {
+	cfi, err := os.Stat(cc.certFile)
+	if err != nil {
+		return cc.current(), err
+	}
+
+	kfi, err := os.Stat(cc.keyFile)
+	if err != nil {
+		return cc.current(), err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.cert != nil && cfi.ModTime().Equal(cc.certMod) && kfi.ModTime().Equal(cc.keyMod) {
+		return cc.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		return cc.cert, err
+	}
+
+	cc.cert, cc.certMod, cc.keyMod = &cert, cfi.ModTime(), kfi.ModTime()
+	return cc.cert, nil
+}
+
+func (cc *clientCert) current() *tls.Certificate {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.cert
+}
@@ -0,0 +1,160 @@
+package chromekiosk
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProxyCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Seen-Key", r.Header.Get("X-Api-Key"))
+	}))
+	defer upstream.Close()
+
+	var (
+		dir       = t.TempDir()
+		tokenFile = filepath.Join(dir, "token")
+		credsFile = filepath.Join(dir, "credentials.json")
+	)
+
+	t.Setenv("CHROMEKIOSK_TEST_KEY", "key1")
+
+	if err := os.WriteFile(tokenFile, []byte("tok1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := `[
+		{"hosts": ["127.0.0.1"], "bearer": {"file": "` + tokenFile + `"}, "headers": {"X-Api-Key": {"env": "CHROMEKIOSK_TEST_KEY"}}},
+		{"hosts": ["*.example.com"], "basicUser": "kiosk", "basicPassword": {"value": "pw"}}
+	]`
+	if err := os.WriteFile(credsFile, []byte(creds), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var pr Proxy
+	if err := pr.LoadCredentialsFile(credsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func() *http.Response {
+		r := httptest.NewRequest("GET", upstream.URL+"/", nil)
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	resp := do()
+	if got := resp.Header.Get("X-Seen-Auth"); got != "Bearer tok1" {
+		t.Errorf("Authorization %q", got)
+	}
+	if got := resp.Header.Get("X-Seen-Key"); got != "key1" {
+		t.Errorf("X-Api-Key %q", got)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("tok2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pr.LoadCredentialsFile(credsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := do().Header.Get("X-Seen-Auth"); got != "Bearer tok2" {
+		t.Errorf("reloaded Authorization %q", got)
+	}
+
+	if hdr := pr.Credentials().header("www.example.com"); hdr.Get("Authorization") != "Basic a2lvc2s6cHc=" {
+		t.Errorf("basic auth %q", hdr.Get("Authorization"))
+	}
+
+	t.Setenv("CHROMEKIOSK_TEST_KEY", "")
+	os.Unsetenv("CHROMEKIOSK_TEST_KEY")
+
+	if err := pr.LoadCredentialsFile(credsFile); err == nil {
+		t.Errorf("missing environment variable not reported")
+	}
+}
+
+func TestProxyClientCertificate(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		io.WriteString(w, r.TLS.PeerCertificates[0].SerialNumber.String())
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	var (
+		dir       = t.TempDir()
+		credsFile = filepath.Join(dir, "credentials.json")
+		modTime   = time.Now()
+	)
+
+	// newCert writes a fresh client certificate, as a rotation would.
+	newCert := func() *tls.Certificate {
+		ca, err := NewCertAuthority()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveCertificate(dir, ca.Root()); err != nil {
+			t.Fatal(err)
+		}
+
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(filepath.Join(dir, caCertFile), modTime, modTime)
+		os.Chtimes(filepath.Join(dir, caKeyFile), modTime, modTime)
+		return ca.Root()
+	}
+
+	cert := newCert()
+
+	creds := `[{"hosts": ["127.0.0.1"], "clientCert": "` + filepath.Join(dir, caCertFile) + `", "clientKey": "` + filepath.Join(dir, caKeyFile) + `"}]`
+	if err := os.WriteFile(credsFile, []byte(creds), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var pr Proxy
+	if err := pr.LoadCredentialsFile(credsFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.SetUpstreamTLS(&UpstreamTLS{Rules: []UpstreamTLSRule{{Hosts: []string{"127.0.0.1"}, Insecure: true}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if config, _ := pr.upstreamTLSConfig("dashboard.test"); config.GetClientCertificate != nil {
+		t.Errorf("client certificate for unmatched host")
+	}
+
+	check := func(what string) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, httptest.NewRequest("GET", upstream.URL+"/", nil))
+
+		if want := cert.Leaf.SerialNumber.String(); w.Body.String() != want {
+			t.Errorf("%s: got %d %q, want %q", what, w.Code, w.Body, want)
+		}
+	}
+
+	check("loaded")
+
+	cert = newCert()
+	check("reloaded")
+
+	// The TLS connection through an upstream proxy is still the proxy's own.
+	httpProxy, hits := newTestHTTPProxy(t, "")
+	pr.Upstream, _ = ParseUpstreamProxy(httpProxy.URL, "")
+
+	check("upstream proxy")
+
+	if hits.Load() != 1 {
+		t.Errorf("upstream proxy: %d requests", hits.Load())
+	}
+}
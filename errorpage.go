@@ -0,0 +1,132 @@
+package chromekiosk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultErrorPageTemplate is shown in place of pages whose upstream could
+// not be reached. It keeps retrying the original URL in the background, with
+// backoff, and reloads once it answers.
+const DefaultErrorPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+html, body { height: 100%; margin: 0; }
+body { display: flex; align-items: center; justify-content: center; background: #111; color: #ddd; font-family: sans-serif; text-align: center; }
+img { max-width: 40vw; max-height: 30vh; margin-bottom: 2em; }
+h1 { font-weight: normal; font-size: 2.5em; margin: 0 0 0.5em; }
+p { color: #888; margin: 0.25em; }
+</style>
+</head>
+<body>
+<div>
+{{if .Logo}}<img src="{{.Logo}}" alt="">{{end}}
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p>{{.Hostname}} &middot; {{.Status}}</p>
+</div>
+<script>
+(function() {
+	var delay = 2000, maxDelay = 60000;
+
+	function schedule() {
+		setTimeout(retry, delay);
+		delay = Math.min(delay * 2, maxDelay);
+	}
+
+	function retry() {
+		fetch(location.href, { cache: "no-store" }).then(function(resp) {
+			if (resp.ok) {
+				location.reload();
+			} else {
+				schedule();
+			}
+		}, schedule);
+	}
+
+	schedule();
+})();
+</script>
+</body>
+</html>
+`
+
+var defaultErrorPage = template.Must(template.New("error").Parse(DefaultErrorPageTemplate))
+
+type ErrorPageData struct {
+	Title    string
+	Message  string
+	URL      string
+	Status   int
+	Hostname string
+	Logo     template.URL
+}
+
+func LoadErrorPageTemplate(name string) (*template.Template, error) {
+	return template.ParseFiles(name)
+}
+
+// LoadErrorLogo reads an image file into a data URI, so that the error page
+// can show it while upstream is unreachable.
+func LoadErrorLogo(name string) (template.URL, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+
+	typ := mime.TypeByExtension(filepath.Ext(name))
+	if typ == "" {
+		typ = http.DetectContentType(data)
+	}
+
+	return template.URL("data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// upstreamError reports a failure to reach upstream. Requests from a page
+// load get the error page, everything else a bare status without the
+// underlying error text.
+func (pr *Proxy) upstreamError(w http.ResponseWriter, r *http.Request, code int) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	tmpl := pr.ErrorPage
+	if tmpl == nil {
+		tmpl = defaultErrorPage
+	}
+
+	hostname, _ := os.Hostname()
+
+	data := ErrorPageData{
+		Title:    "This page is temporarily unavailable",
+		Message:  "It will reappear automatically as soon as it can be reached.",
+		URL:      r.URL.String(),
+		Status:   code,
+		Hostname: hostname,
+		Logo:     pr.ErrorLogo,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		pr.logger("proxy").Warn("error page", "err", err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/html; charset=utf-8")
+	hdr.Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,134 @@
+package chromekiosk
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Hop-by-hop headers, which apply to a single connection and so are not
+// forwarded (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the hop-by-hop headers from h, including any named
+// by Connection.
+func removeHopByHop(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol requested by an Upgrade, if any.
+func upgradeType(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// forwardRequestHeader prepares the header of req, forwarded for r.
+func (pr *Proxy) forwardRequestHeader(req, r *http.Request) {
+	h := req.Header
+
+	var (
+		upgrade  = upgradeType(h)
+		trailers = strings.Contains(strings.ToLower(strings.Join(h.Values("Te"), ",")), "trailers")
+	)
+
+	removeHopByHop(h)
+
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+
+	// Let upstream know that trailers can be forwarded.
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+
+	if pr.ForwardedFor {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			h.Set("X-Forwarded-For", ip)
+		}
+	}
+
+	if pr.Via != "" {
+		h.Add("Via", via(r.ProtoMajor, r.ProtoMinor, pr.Via))
+	}
+}
+
+// forwardResponseHeader copies the end-to-end headers of resp to w.
+func (pr *Proxy) forwardResponseHeader(w http.ResponseWriter, resp *http.Response) {
+	removeHopByHop(resp.Header)
+
+	hdr := w.Header()
+
+	for k, vs := range resp.Header {
+		hdr[k] = append(hdr[k], vs...)
+	}
+
+	if pr.Via != "" {
+		hdr.Add("Via", via(resp.ProtoMajor, resp.ProtoMinor, pr.Via))
+	}
+
+	// Announce the trailers, whose values are only known after the body.
+	for k := range resp.Trailer {
+		hdr.Add("Trailer", k)
+	}
+}
+
+// forwardTrailer copies the trailers of resp to w, after the body.
+func forwardTrailer(w http.ResponseWriter, resp *http.Response) {
+	hdr := w.Header()
+	announced := hdr.Values("Trailer")
+
+	for k, vs := range resp.Trailer {
+		if !containsFold(announced, k) {
+			k = http.TrailerPrefix + k
+		}
+		hdr[k] = vs
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func via(major, minor int, pseudonym string) string {
+	if major == 1 {
+		return fmt.Sprintf("1.%d %s", minor, pseudonym)
+	}
+	return fmt.Sprintf("%d %s", major, pseudonym)
+}
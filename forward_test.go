@@ -0,0 +1,133 @@
+package chromekiosk
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxyForwarding(t *testing.T) {
+	var remotes []string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remotes = append(remotes, r.RemoteAddr)
+
+		for _, k := range []string{"Proxy-Authorization", "Keep-Alive", "X-Hop"} {
+			if v := r.Header.Get(k); v != "" {
+				t.Errorf("hop-by-hop %s: %s forwarded", k, v)
+			}
+		}
+
+		if got := r.Header.Get("Via"); got != "1.1 kiosk" {
+			t.Errorf("Via: %q", got)
+		}
+
+		if got := r.Header.Get("X-Forwarded-For"); got != "10.0.0.1, 127.0.0.1" {
+			t.Errorf("X-Forwarded-For: %q", got)
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "id="+r.URL.Query().Get("id"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	var pr = Proxy{Via: "kiosk", ForwardedFor: true}
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	for range 2 {
+		req, _ := http.NewRequest("GET", upstream.URL+"/dashboard?id=42#top", nil)
+		req.Header.Set("Proxy-Authorization", "Basic eDp5")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "id=42" {
+			t.Errorf("query not forwarded: %q", body)
+		}
+
+		if resp.Close {
+			t.Errorf("client connection closed")
+		}
+
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+			t.Errorf("trailer: %q", got)
+		}
+
+		if !strings.HasPrefix(resp.Header.Get("Via"), "1.1 kiosk") {
+			t.Errorf("response Via: %q", resp.Header.Get("Via"))
+		}
+	}
+
+	if len(remotes) != 2 || remotes[0] != remotes[1] {
+		t.Errorf("upstream connection not reused: %v", remotes)
+	}
+}
+
+func TestProxyForwardContentLength(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.ContentLength != 5 || string(body) != "hello" {
+			t.Errorf("request body: %d %q", r.ContentLength, body)
+		}
+
+		io.WriteString(w, "0123456789")
+	}))
+	defer upstream.Close()
+
+	var pr Proxy
+
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, httptest.NewRequest("POST", upstream.URL+"/", strings.NewReader("hello")))
+
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("Content-Length: %q", got)
+	}
+}
+
+func TestProxyTruncatedBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+
+		// Drop the connection without ending the chunked body.
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	var pr Proxy
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get(upstream.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("truncated body read cleanly: %q", body)
+	}
+}
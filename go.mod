@@ -6,6 +6,7 @@ require (
 	github.com/chromedp/cdproto v0.0.0-20250429231605-6ed5b53462d4
 	github.com/chromedp/chromedp v0.13.6
 	github.com/vishvananda/netlink v1.3.0
+	golang.org/x/net v0.38.0
 	golang.org/x/sys v0.32.0
 )
 
@@ -16,4 +17,5 @@ require (
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.4.0 // indirect
 	github.com/vishvananda/netns v0.0.4 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,287 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// acceptTunnel answers a CONNECT request with 200 and returns the client
+// side of the tunnel. HTTP/1 connections are hijacked; HTTP/2 streams
+// cannot be, so their request and response bodies carry the tunnel.
+func (pr *Proxy) acceptTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor >= 2 {
+		w.WriteHeader(http.StatusOK)
+
+		conn := newStreamConn(w, r)
+		if err := conn.rc.Flush(); err != nil {
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "ResponseWriter does not implement http.Hijacker", http.StatusInternalServerError)
+		return nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	return &bufConn{Conn: conn, r: bufrw.Reader}, nil
+}
+
+// extendedConnect turns an RFC 8441 extended CONNECT, which is how
+// WebSockets are opened over HTTP/2, into the equivalent HTTP/1.1 upgrade
+// request, so that it is checked and forwarded like any other. The
+// request body remains the client side of the stream.
+//
+// Go's HTTP/2 server only offers extended CONNECT when the process is
+// started with GODEBUG=http2xconnect=1, which neither //go:debug nor go.mod
+// accept; otherwise Chrome opens WebSockets over HTTP/1.1.
+func extendedConnect(r *http.Request) *http.Request {
+	protocol := r.Header.Get(":protocol")
+
+	r = r.Clone(r.Context())
+	r.Method = http.MethodGet
+	r.Header.Del(":protocol")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", protocol)
+
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
+	}
+
+	if r.URL.Scheme == "" && r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+
+	if protocol == "websocket" && r.Header.Get("Sec-Websocket-Key") == "" {
+		var key [16]byte
+		rand.Read(key[:])
+		r.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+	}
+
+	return r
+}
+
+// streamConn is a net.Conn over the bodies of an HTTP/2 stream.
+//
+// A read deadline that has passed breaks an HTTP/2 request body for good,
+// whereas http.Server sets one on every hijack to interrupt its background
+// read, so reads are done by a separate goroutine and their deadline is
+// kept here instead.
+type streamConn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+
+	pumpOnce  sync.Once
+	readc     chan streamRead
+	consumedc chan struct{}
+	readMu    sync.Mutex
+	pending   []byte
+	err       error
+	deadline  streamDeadline
+
+	closeOnce sync.Once
+	closec    chan struct{}
+}
+
+type streamRead struct {
+	p   []byte
+	err error
+}
+
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	c := streamConn{
+		body:      r.Body,
+		w:         w,
+		rc:        http.NewResponseController(w),
+		remote:    streamAddr(r.RemoteAddr),
+		readc:     make(chan streamRead),
+		consumedc: make(chan struct{}),
+		closec:    make(chan struct{}),
+		deadline:  streamDeadline{cancel: make(chan struct{})},
+	}
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	} else {
+		c.local = streamAddr("")
+	}
+
+	return &c
+}
+
+func (c *streamConn) pump() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.body.Read(buf)
+
+		select {
+		case c.readc <- streamRead{buf[:n], err}:
+		case <-c.closec:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-c.consumedc:
+		case <-c.closec:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		c.pumpOnce.Do(func() { go c.pump() })
+
+		select {
+		case r := <-c.readc:
+			c.pending, c.err = r.p, r.err
+		case <-c.deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closec:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	if len(c.pending) > 0 {
+		return n, nil
+	}
+
+	if c.err != nil {
+		return n, c.err
+	}
+
+	select {
+	case c.consumedc <- struct{}{}:
+	case <-c.closec:
+	}
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closec)
+		err = c.body.Close()
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { c.deadline.set(t); return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// streamDeadline is a read deadline, whose cancel channel is closed once it
+// has passed, and replaced when it is moved into the future.
+type streamDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func (d *streamDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer to close it.
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *streamDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
+// intercept needs a buffered reader over the tunnel, as from a hijack.
+func tunnelReader(conn net.Conn) *bufio.Reader {
+	if bc, ok := conn.(*bufConn); ok {
+		return bc.r
+	}
+	return bufio.NewReader(conn)
+}
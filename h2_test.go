@@ -0,0 +1,191 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestProxyHTTP2(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{
+		HostMap: map[string]string{"dashboard.test": "127.0.0.1"},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go runTLSProxy(ctx, ln, &pr, ca)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	authority := net.JoinHostPort("dashboard.test", port)
+
+	req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/panel", nil)
+	req.Host = authority
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 || string(body) != "hello /panel" {
+		t.Errorf("got %s %q", resp.Proto, body)
+	}
+
+	// CONNECT over HTTP/2 tunnels through the request and response bodies.
+	pr2, pw := io.Pipe()
+	req, _ = http.NewRequest("CONNECT", "https://"+ln.Addr().String(), pr2)
+	req.Host = authority
+
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: got %s %s", resp.Proto, resp.Status)
+	}
+
+	go io.WriteString(pw, "GET /tunnel HTTP/1.1\r\nHost: "+authority+"\r\n\r\n")
+
+	tresp, err := http.ReadResponse(bufio.NewReader(resp.Body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(tresp.Body)
+
+	if string(body) != "hello /tunnel" {
+		t.Errorf("CONNECT: got %q", body)
+	}
+	pw.Close()
+}
+
+func TestProxyExtendedConnect(t *testing.T) {
+	// The HTTP/2 server reads GODEBUG as the process starts, so run the
+	// test again in one that has it.
+	if godebug := os.Getenv("GODEBUG"); !strings.Contains(godebug, "http2xconnect=1") {
+		if godebug != "" {
+			godebug += ","
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestProxyExtendedConnect$")
+		cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %s", err, out)
+		}
+		return
+	}
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-Websocket-Key") == "" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		conn, bufrw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: x\r\n\r\n")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer upstream.Close()
+
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{
+		HostMap:   map[string]string{"dashboard.test": "127.0.0.1"},
+		Transport: upstream.Client().Transport,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go runTLSProxy(ctx, ln, &pr, ca)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	// net/http's client refuses the :protocol pseudo-header.
+	client := http.Client{
+		Transport: &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	reqr, reqw := io.Pipe()
+	defer reqw.Close()
+
+	req, _ := http.NewRequest("CONNECT", "https://"+ln.Addr().String()+"/ws", reqr)
+	req.Host = "dashboard.test:" + port
+	req.Header.Set(":protocol", "websocket")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s %s", resp.Proto, resp.Status)
+	}
+
+	if resp.Header.Get("Upgrade") != "" || resp.Header.Get("Sec-Websocket-Accept") != "" {
+		t.Errorf("hop-by-hop headers forwarded: %v", resp.Header)
+	}
+
+	io.WriteString(reqw, "ping")
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo: got %q %v", buf, err)
+	}
+}
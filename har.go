@@ -0,0 +1,397 @@
+package chromekiosk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAR 1.2, as described at http://www.softwareishard.com/blog/har-12-spec/.
+// Only the parts the proxy can observe are filled in.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+const DefaultHARSize = 500
+
+const harRedacted = "(redacted)"
+
+// Headers whose values are left out of a HAR, besides credential headers.
+var harSecretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// HARRecorder keeps the most recent Size proxied requests. If MaxBodySize
+// is positive, request and response bodies are kept too, truncated to that
+// many bytes. Cookies, Authorization and credential headers are recorded as
+// harRedacted, unless KeepSecrets is set.
+type HARRecorder struct {
+	Size        int
+	MaxBodySize int64
+	KeepSecrets bool
+
+	mu      sync.Mutex
+	entries []HAREntry
+	next    int
+}
+
+func (h *HARRecorder) add(e HAREntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	size := h.Size
+	if size <= 0 {
+		size = DefaultHARSize
+	}
+
+	if len(h.entries) < size {
+		h.entries = append(h.entries, e)
+		return
+	}
+
+	h.entries[h.next%len(h.entries)] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// HAR returns the recorded entries, oldest first.
+func (h *HARRecorder) HAR() *HAR {
+	h.mu.Lock()
+	entries := make([]HAREntry, 0, len(h.entries))
+	entries = append(entries, h.entries[h.next:]...)
+	entries = append(entries, h.entries[:h.next]...)
+	h.mu.Unlock()
+
+	return &HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "chromekiosk", Version: "1"},
+			Entries: entries,
+		},
+	}
+}
+
+func (h *HARRecorder) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = nil
+	h.next = 0
+}
+
+func (h *HARRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out, err := json.MarshalIndent(h.HAR(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/json")
+	hdr.Set("Content-Disposition", `attachment; filename="chromekiosk.har"`)
+	w.Write(out)
+}
+
+// harPending accumulates a HAREntry over the lifetime of a request.
+type harPending struct {
+	h       *HARRecorder
+	start   time.Time
+	sent    time.Time
+	entry   HAREntry
+	reqBody *limitedBuffer
+	reqN    *countingReader
+	respBuf *limitedBuffer
+}
+
+// begin starts an entry for the client request r, which is forwarded
+// upstream as req with the credential headers cred added.
+func (h *HARRecorder) begin(r, req *http.Request, cred http.Header) *harPending {
+	if h == nil {
+		return nil
+	}
+
+	p := &harPending{
+		h:     h,
+		start: time.Now(),
+		entry: HAREntry{
+			Request: HARRequest{
+				Method:      req.Method,
+				URL:         req.URL.String(),
+				HTTPVersion: r.Proto,
+				Cookies:     h.cookies(req.Cookies()),
+				Headers:     h.headers(req.Header, cred),
+				QueryString: harQuery(req.URL.Query()),
+				HeadersSize: -1,
+			},
+		},
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		p.reqN = &countingReader{r: req.Body}
+		var body io.Reader = p.reqN
+
+		if h.MaxBodySize > 0 {
+			p.reqBody = &limitedBuffer{max: h.MaxBodySize}
+			body = io.TeeReader(body, p.reqBody)
+		}
+
+		req.Body = readCloser{body, req.Body}
+	}
+
+	return p
+}
+
+func (p *harPending) response(resp *http.Response) {
+	if p == nil {
+		return
+	}
+
+	p.sent = time.Now()
+
+	e := &p.entry
+	if n := p.reqN; n != nil {
+		e.Request.BodySize = n.n
+	}
+
+	if b := p.reqBody; b != nil {
+		e.Request.PostData = &HARPostData{MimeType: e.requestHeader("Content-Type")}
+		e.Request.PostData.Text, e.Request.PostData.Encoding = harText(b.Bytes(), e.Request.PostData.MimeType)
+	}
+
+	e.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     p.h.cookies(resp.Cookies()),
+		Headers:     p.h.headers(resp.Header, nil),
+		Content:     HARContent{MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	if p.h.MaxBodySize > 0 {
+		p.respBuf = &limitedBuffer{max: p.h.MaxBodySize}
+	}
+}
+
+// body returns a writer that should be sent a copy of the response body.
+func (p *harPending) body() io.Writer {
+	if p == nil || p.respBuf == nil {
+		return io.Discard
+	}
+	return p.respBuf
+}
+
+func (p *harPending) finish(bodySize int64, err error) {
+	if p == nil {
+		return
+	}
+
+	var (
+		now = time.Now()
+		e   = &p.entry
+	)
+
+	if p.sent.IsZero() {
+		p.sent = now
+		e.Response = HARResponse{
+			Cookies:     []HARCookie{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+	} else {
+		e.Response.BodySize = bodySize
+		e.Response.Content.Size = bodySize
+
+		if b := p.respBuf; b != nil {
+			e.Response.Content.Text, e.Response.Content.Encoding = harText(b.Bytes(), e.Response.Content.MimeType)
+		}
+	}
+
+	if err != nil {
+		e.Comment = err.Error()
+	}
+
+	e.StartedDateTime = p.start
+	e.Timings = HARTimings{
+		Wait:    millis(p.sent.Sub(p.start)),
+		Receive: millis(now.Sub(p.sent)),
+	}
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+
+	p.h.add(*e)
+}
+
+func (e *HAREntry) requestHeader(name string) string {
+	for _, nv := range e.Request.Headers {
+		if strings.EqualFold(nv.Name, name) {
+			return nv.Value
+		}
+	}
+	return ""
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// headers lists hdr, with the values of harSecretHeaders and of any header
+// named in cred redacted.
+func (h *HARRecorder) headers(hdr, cred http.Header) []HARNameValue {
+	out := []HARNameValue{}
+	for k, vs := range hdr {
+		secret := !h.KeepSecrets && (slices.Contains(harSecretHeaders, k) || cred[k] != nil)
+		for _, v := range vs {
+			if secret {
+				v = harRedacted
+			}
+			out = append(out, HARNameValue{k, v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (h *HARRecorder) cookies(cookies []*http.Cookie) []HARCookie {
+	out := []HARCookie{}
+	for _, c := range cookies {
+		v := c.Value
+		if !h.KeepSecrets {
+			v = harRedacted
+		}
+		out = append(out, HARCookie{c.Name, v})
+	}
+	return out
+}
+
+func harQuery(query url.Values) []HARNameValue {
+	out := []HARNameValue{}
+	for k, vs := range query {
+		for _, v := range vs {
+			out = append(out, HARNameValue{k, v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func harText(data []byte, contentType string) (text, encoding string) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "xml"),
+		strings.HasSuffix(mediaType, "javascript"),
+		mediaType == "application/x-www-form-urlencoded":
+		return string(data), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// limitedBuffer keeps the first max bytes written to it, and silently
+// discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - int64(b.Len()); room > 0 {
+		b.Buffer.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
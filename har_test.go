@@ -0,0 +1,73 @@
+package chromekiosk
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHAR(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "echo "+string(body))
+	}))
+	defer upstream.Close()
+
+	var pr = Proxy{
+		HAR: &HARRecorder{Size: 2, MaxBodySize: 8},
+	}
+
+	for _, body := range []string{"one", "two", "three"} {
+		r := httptest.NewRequest("POST", upstream.URL+"/post?n="+body, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		r.Header.Set("Cookie", "session=secret")
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+	}
+
+	rec := httptest.NewRecorder()
+	pr.HAR.ServeHTTP(rec, httptest.NewRequest("GET", "/har", nil))
+
+	var har HAR
+	if err := json.Unmarshal(rec.Body.Bytes(), &har); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(har.Log.Entries); n != 2 {
+		t.Fatalf("%d entries", n)
+	}
+
+	e := har.Log.Entries[1]
+
+	if e.Request.Method != "POST" || e.Request.QueryString[0].Value != "three" {
+		t.Errorf("request %+v", e.Request)
+	}
+
+	if e.Request.HTTPVersion != "HTTP/1.1" {
+		t.Errorf("httpVersion %q", e.Request.HTTPVersion)
+	}
+
+	if got := e.Request.Cookies; len(got) != 1 || got[0].Value != harRedacted || e.requestHeader("Cookie") != harRedacted {
+		t.Errorf("cookies not redacted: %+v", e.Request)
+	}
+
+	if e.Request.PostData == nil || e.Request.PostData.Text != "three" || e.Request.BodySize != 5 {
+		t.Errorf("postData %+v", e.Request.PostData)
+	}
+
+	if e.Response.Status != 200 || e.Response.Content.Size != int64(len("echo three")) {
+		t.Errorf("response %+v", e.Response)
+	}
+
+	if got := e.Response.Content.Text; got != "echo thr" {
+		t.Errorf("truncated body %q", got)
+	}
+
+	if har.Log.Entries[0].Request.QueryString[0].Value != "two" {
+		t.Errorf("entries out of order")
+	}
+}
@@ -0,0 +1,281 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// HostTarget is where requests for a mapped hostname are sent: another
+// host, optionally on a different port, or a unix domain socket.
+type HostTarget struct {
+	Host string
+	Port string // If set, replaces the requested port
+	Unix string // Path of a unix domain socket; Host and Port are unused
+}
+
+// ParseHostTarget parses "HOST", "HOST:PORT", "[IPV6]:PORT" or
+// "unix:/path/to/socket".
+func ParseHostTarget(s string) (HostTarget, error) {
+	if p, ok := strings.CutPrefix(s, "unix:"); ok {
+		if p == "" {
+			return HostTarget{}, fmt.Errorf("host target %q: empty socket path", s)
+		}
+		return HostTarget{Unix: p}, nil
+	}
+
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return HostTarget{Host: host, Port: port}, nil
+	}
+
+	host := strings.Trim(s, "[]")
+	if host == "" {
+		return HostTarget{}, fmt.Errorf("host target %q: empty host", s)
+	}
+
+	return HostTarget{Host: host}, nil
+}
+
+func (t HostTarget) String() string {
+	switch {
+	case t.Unix != "":
+		return "unix:" + t.Unix
+	case t.Port != "":
+		return net.JoinHostPort(t.Host, t.Port)
+	}
+	return t.Host
+}
+
+// addr is the address to dial instead of one on port.
+func (t HostTarget) addr(port string) string {
+	if t.Port != "" {
+		port = t.Port
+	}
+	return net.JoinHostPort(t.Host, port)
+}
+
+// HostTable maps hostnames to targets. Names may be exact or globs such as
+// "*.kiosk.localhost"; exact names take precedence, then the longest
+// matching glob.
+type HostTable struct {
+	exact map[string]HostTarget
+	globs []string
+	glob  map[string]HostTarget
+}
+
+// NewHostTable builds a table from m, mapping names to targets as for
+// ParseHostTarget. Entries that cannot be used are left out of the table
+// and reported together in the error.
+func NewHostTable(m map[string]string) (*HostTable, error) {
+	var (
+		t    HostTable
+		errs []error
+	)
+
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		target, err := ParseHostTarget(m[name])
+		if err == nil {
+			err = t.add(name, target)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return &t, errors.Join(errs...)
+}
+
+// ParseHostTable reads an /etc/hosts-like table with lines of the form
+// "TARGET NAME...", where TARGET is as for ParseHostTarget. Text after a
+// '#' is ignored.
+func ParseHostTable(r io.Reader) (*HostTable, error) {
+	var (
+		t  HostTable
+		sc = bufio.NewScanner(r)
+		n  int
+	)
+
+	for sc.Scan() {
+		n++
+
+		line, _, _ := strings.Cut(sc.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: missing hostname", n)
+		}
+
+		target, err := ParseHostTarget(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		for _, name := range fields[1:] {
+			if err := t.add(name, target); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func ReadHostsFile(name string) (*HostTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := ParseHostTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("hosts %s: %w", name, err)
+	}
+
+	return t, nil
+}
+
+func (t *HostTable) add(name string, target HostTarget) error {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if !strings.ContainsAny(name, "*?[") {
+		if t.exact == nil {
+			t.exact = make(map[string]HostTarget)
+		}
+		t.exact[name] = target
+		return nil
+	}
+
+	if _, err := path.Match(name, ""); err != nil {
+		return fmt.Errorf("bad hostname pattern %q: %w", name, err)
+	}
+
+	if t.glob == nil {
+		t.glob = make(map[string]HostTarget)
+	}
+
+	if _, ok := t.glob[name]; !ok {
+		t.globs = append(t.globs, name)
+		slices.SortStableFunc(t.globs, func(a, b string) int { return len(b) - len(a) })
+	}
+	t.glob[name] = target
+	return nil
+}
+
+func (t *HostTable) Lookup(host string) (HostTarget, bool) {
+	if t == nil {
+		return HostTarget{}, false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if target, ok := t.exact[host]; ok {
+		return target, true
+	}
+
+	for _, pat := range t.globs {
+		if matchHostGlob(pat, host) {
+			return t.glob[pat], true
+		}
+	}
+
+	return HostTarget{}, false
+}
+
+func (pr *Proxy) Hosts() *HostTable { return pr.hosts.Load() }
+
+// SetHosts atomically replaces the host table, which is consulted before
+// HostMap, and closes idle connections made under the old one.
+func (pr *Proxy) SetHosts(t *HostTable) {
+	pr.hosts.Store(t)
+	pr.closeIdleConnections()
+}
+
+func (pr *Proxy) LoadHostsFile(name string) error {
+	t, err := ReadHostsFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetHosts(t)
+	return nil
+}
+
+// mapHost translates host through the host table and then HostMap.
+func (pr *Proxy) mapHost(host string) (HostTarget, bool) {
+	if target, ok := pr.Hosts().Lookup(host); ok {
+		return target, true
+	}
+
+	pr.compileHostMap()
+
+	return pr.hostMap.Lookup(host)
+}
+
+// compileHostMap builds the table for HostMap, once, returning an error
+// for any entries that were left out of it.
+func (pr *Proxy) compileHostMap() error {
+	pr.hostMapOnce.Do(func() {
+		if len(pr.HostMap) == 0 {
+			return
+		}
+
+		pr.hostMap, pr.hostMapErr = NewHostTable(pr.HostMap)
+		if pr.hostMapErr != nil {
+			pr.logger("proxy").Warn("HostMap entries skipped", "err", pr.hostMapErr)
+		}
+	})
+
+	return pr.hostMapErr
+}
+
+// dialTarget dials a tunnel to addr after host translation.
+func (pr *Proxy) dialTarget(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+
+	if target, ok := pr.mapHost(host); ok && target.Unix != "" {
+		conn, err = pr.Dialer.DialContext(ctx, "unix", target.Unix)
+	} else {
+		if ok {
+			addr = target.addr(port)
+		}
+		conn, err = pr.dial(ctx, "tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pr.throttleConn(ctx, host, conn)
+}
+
+// unixSocketKey carries the socket path of a request mapped to a unix
+// domain socket through to dial.
+type unixSocketKey struct{}
+
+// hostTargetKey carries the HostTarget of an HTTPS request mapped to
+// another address through to dial, so that the connection is still made,
+// verified and pooled for the requested host.
+type hostTargetKey struct{}
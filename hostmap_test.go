@@ -0,0 +1,110 @@
+package chromekiosk
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHostTable(t *testing.T) {
+	const hosts = `
+# kiosk apps
+127.0.0.1            kiosk.localhost chromekiosk.localhost
+127.0.0.1:3000       app.localhost
+[::1]:8080           *.kiosk.localhost
+10.0.0.1             *.localhost
+unix:/run/app.sock   sock.localhost   # local app
+`
+
+	tbl, err := ParseHostTable(strings.NewReader(hosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testcases = []struct {
+		host   string
+		expect string
+	}{
+		{"kiosk.localhost", "127.0.0.1"},
+		{"Chromekiosk.localhost.", "127.0.0.1"},
+		{"app.localhost", "127.0.0.1:3000"},
+		{"a.kiosk.localhost", "[::1]:8080"},
+		{"other.localhost", "10.0.0.1"},
+		{"sock.localhost", "unix:/run/app.sock"},
+		{"example.com", ""},
+	}
+
+	for _, tc := range testcases {
+		target, ok := tbl.Lookup(tc.host)
+		if got := target.String(); got != tc.expect || ok != (tc.expect != "") {
+			t.Errorf("%s: got %q %v, expect %q", tc.host, got, ok, tc.expect)
+		}
+	}
+
+	if _, err := ParseHostTable(strings.NewReader("127.0.0.1\n")); err == nil {
+		t.Errorf("expected error for missing hostname")
+	}
+
+	// A bad entry is reported, but does not take the others with it.
+	pr := Proxy{HostMap: map[string]string{"[bad.localhost": "127.0.0.1", "good.localhost": "127.0.0.2"}}
+
+	if err := pr.compileHostMap(); err == nil || !strings.Contains(err.Error(), "[bad.localhost") {
+		t.Errorf("bad HostMap entry: got %v", err)
+	}
+
+	if target, ok := pr.mapHost("good.localhost"); !ok || target.Host != "127.0.0.2" {
+		t.Errorf("good HostMap entry: got %v %v", target, ok)
+	}
+}
+
+func TestProxyHostMap(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})
+
+	tcp := httptest.NewServer(handler)
+	defer tcp.Close()
+
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unix := httptest.NewUnstartedServer(handler)
+	unix.Listener = ln
+	unix.Start()
+	defer unix.Close()
+
+	var pr = Proxy{
+		HostMap: map[string]string{
+			"*.app.test": tcp.Listener.Addr().String(),
+		},
+	}
+
+	tbl, err := NewHostTable(map[string]string{"sock.test": "unix:" + sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.SetHosts(tbl)
+
+	for _, u := range []string{"http://a.app.test/", "http://sock.test/"} {
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+		if got, want := w.Body.String(), strings.TrimSuffix(u[len("http://"):], "/"); got != want {
+			t.Errorf("%s: got %d %q", u, w.Code, got)
+		}
+	}
+
+	// A custom Transport cannot reach unix socket targets.
+	pr.Transport = http.DefaultTransport
+
+	if _, err := pr.RoundTrip(httptest.NewRequest("GET", "http://sock.test/", nil)); err == nil {
+		t.Errorf("unix socket with Transport set: expected error")
+	}
+}
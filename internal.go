@@ -0,0 +1,278 @@
+package chromekiosk
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InternalRequestRule matches background requests that Chrome makes on its
+// own. Empty fields match anything; Host may be a glob, and rules with a
+// PathPrefix never match CONNECT.
+type InternalRequestRule struct {
+	Method     string `json:"method,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+	Host       string `json:"host"`
+	Port       string `json:"port,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty"`
+}
+
+var DefaultInternalRequestRules = []InternalRequestRule{
+	{Method: "CONNECT", Host: "accounts.google.com", Port: "443"},
+	{Method: "CONNECT", Host: "content-autofill.googleapis.com", Port: "443"},
+	{Method: "CONNECT", Host: "optimizationguide-pa.googleapis.com", Port: "443"},
+	{Method: "CONNECT", Host: "safebrowsingohttpgateway.googleapis.com", Port: "443"},
+	{Method: "CONNECT", Host: "update.googleapis.com", Port: "443"},
+	{Method: "CONNECT", Host: "www.google.com", Port: "443"},
+	{Method: "GET", Scheme: "http", Host: "clients2.google.com", PathPrefix: "/time/1/current"},
+	{Method: "POST", Scheme: "http", Host: "update.googleapis.com", PathPrefix: "/service/update2/json"},
+}
+
+var DefaultInternalRequests = NewInternalRequestMatcher(DefaultInternalRequestRules)
+
+// InternalRequestMatcher is a compiled set of InternalRequestRules.
+type InternalRequestMatcher struct {
+	exact map[string][]InternalRequestRule
+	globs []InternalRequestRule
+}
+
+func NewInternalRequestMatcher(rules []InternalRequestRule) *InternalRequestMatcher {
+	m := InternalRequestMatcher{
+		exact: make(map[string][]InternalRequestRule),
+	}
+
+	for _, rule := range rules {
+		rule.Host = strings.ToLower(rule.Host)
+
+		if strings.ContainsAny(rule.Host, "*?[") || rule.Host == "" {
+			m.globs = append(m.globs, rule)
+		} else {
+			m.exact[rule.Host] = append(m.exact[rule.Host], rule)
+		}
+	}
+
+	return &m
+}
+
+// ReadInternalRequestsFile reads a JSON array of InternalRequestRules, as
+// served by InternalRequestLearner.
+func ReadInternalRequestsFile(name string) (*InternalRequestMatcher, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []InternalRequestRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("internal requests %s: %w", name, err)
+	}
+
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Host, ""); err != nil {
+			return nil, fmt.Errorf("internal requests %s: bad host pattern %q: %w", name, rule.Host, err)
+		}
+	}
+
+	return NewInternalRequestMatcher(rules), nil
+}
+
+func (m *InternalRequestMatcher) Match(r *http.Request) bool {
+	if m == nil {
+		return false
+	}
+
+	scheme, host, port := requestTarget(r)
+
+	match := func(rule *InternalRequestRule) bool {
+		switch {
+		case rule.Method != "" && !strings.EqualFold(rule.Method, r.Method):
+			return false
+		case rule.Scheme != "" && !strings.EqualFold(rule.Scheme, scheme):
+			return false
+		case rule.Port != "" && rule.Port != port:
+			return false
+		case rule.PathPrefix != "" && (r.Method == http.MethodConnect || !strings.HasPrefix(r.URL.Path, rule.PathPrefix)):
+			return false
+		}
+		return true
+	}
+
+	for i := range m.exact[host] {
+		if match(&m.exact[host][i]) {
+			return true
+		}
+	}
+
+	for i := range m.globs {
+		if rule := &m.globs[i]; (rule.Host == "" || matchHostGlob(rule.Host, host)) && match(rule) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func IsInternalChromeRequest(r *http.Request) bool {
+	return DefaultInternalRequests.Match(r)
+}
+
+func (pr *Proxy) InternalRequests() *InternalRequestMatcher {
+	if m := pr.internal.Load(); m != nil {
+		return m
+	}
+	return DefaultInternalRequests
+}
+
+// SetInternalRequests atomically replaces the matcher for Chrome background
+// requests, which are blocked unless AllowChromeInternal is set; nil
+// restores DefaultInternalRequests.
+func (pr *Proxy) SetInternalRequests(m *InternalRequestMatcher) { pr.internal.Store(m) }
+
+func (pr *Proxy) LoadInternalRequestsFile(name string) error {
+	m, err := ReadInternalRequestsFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetInternalRequests(m)
+	return nil
+}
+
+// blockInternal reports whether r is a Chrome background request that
+// should be blocked, and otherwise gives it to the learner.
+func (pr *Proxy) blockInternal(r *http.Request) bool {
+	if pr.InternalRequests().Match(r) {
+		if !pr.AllowChromeInternal {
+			metricProxyBlockedInternal.Inc()
+			return true
+		}
+		return false
+	}
+
+	if l := pr.LearnInternal; l != nil {
+		l.observe(r)
+	}
+
+	return false
+}
+
+// InternalRequestLearner records requests that are not matched as internal
+// and arrive while Idle reports that no page is loading, as candidate
+// rules for the internal request blocklist. Requests are learned by host
+// and first path segment, and only the first maxLearnedRequests rules are
+// kept; new ones are ignored after that, until Reset.
+type InternalRequestLearner struct {
+	Idle func() bool
+
+	mu   sync.Mutex
+	seen map[InternalRequestRule]*LearnedRequest
+}
+
+const maxLearnedRequests = 1000
+
+type LearnedRequest struct {
+	InternalRequestRule
+	Example string    `json:"example"`
+	Count   int       `json:"count"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+}
+
+func (l *InternalRequestLearner) observe(r *http.Request) {
+	if l.Idle == nil || !l.Idle() {
+		return
+	}
+
+	scheme, host, port := requestTarget(r)
+
+	rule := InternalRequestRule{
+		Method: r.Method,
+		Host:   host,
+		Port:   port,
+	}
+
+	if r.Method != http.MethodConnect {
+		rule.Scheme = scheme
+		rule.PathPrefix = firstPathSegment(r.URL.Path)
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lr, ok := l.seen[rule]
+	if !ok {
+		if len(l.seen) >= maxLearnedRequests {
+			return
+		}
+
+		if l.seen == nil {
+			l.seen = make(map[InternalRequestRule]*LearnedRequest)
+		}
+
+		lr = &LearnedRequest{
+			InternalRequestRule: rule,
+			Example:             r.Method + " " + r.URL.String(),
+			First:               now,
+		}
+		l.seen[rule] = lr
+	}
+
+	lr.Count++
+	lr.Last = now
+}
+
+// Learned returns the recorded requests ordered by host.
+func (l *InternalRequestLearner) Learned() []LearnedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make([]LearnedRequest, 0, len(l.seen))
+	for _, lr := range l.seen {
+		out = append(out, *lr)
+	}
+
+	slices.SortFunc(out, func(a, b LearnedRequest) int {
+		return cmp.Or(
+			cmp.Compare(a.Host, b.Host),
+			cmp.Compare(a.Method, b.Method),
+			cmp.Compare(a.PathPrefix, b.PathPrefix),
+		)
+	})
+
+	return out
+}
+
+func (l *InternalRequestLearner) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seen = nil
+}
+
+// firstPathSegment cuts p after its first segment, so that "/a/b" and
+// "/a/c" are learned as one "/a/" rule.
+func firstPathSegment(p string) string {
+	if i := strings.IndexByte(p[min(1, len(p)):], '/'); i >= 0 {
+		return p[:i+2]
+	}
+	return p
+}
+
+// ServeHTTP writes the learned requests as JSON, which can be edited and
+// loaded with LoadInternalRequestsFile.
+func (l *InternalRequestLearner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(l.Learned())
+}
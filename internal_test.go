@@ -0,0 +1,103 @@
+package chromekiosk
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newInternalTestRequest(s string) *http.Request {
+	method, urlStr, _ := strings.Cut(s, " ")
+	u, _ := url.Parse(urlStr)
+	return &http.Request{Method: method, URL: u, Host: u.Host}
+}
+
+func TestInternalChromeRequests(t *testing.T) {
+	var testcases = []struct {
+		expect bool
+		urlStr string
+	}{
+		{true, "CONNECT //accounts.google.com:443"},
+		{true, "CONNECT //optimizationguide-pa.googleapis.com:443"},
+		{true, "CONNECT //safebrowsingohttpgateway.googleapis.com:443"},
+		{true, "CONNECT //update.googleapis.com:443"},
+		{true, "CONNECT //www.google.com:443"},
+
+		{true, "GET http://clients2.google.com/time/1/current?"},
+		{true, "GET http://clients2.google.com/time/1/current?foo&bar&quux"},
+
+		{true, "POST http://update.googleapis.com/service/update2/json?x"},
+		{true, "POST http://update.googleapis.com/service/update2/json?foo&bar&quux"},
+
+		{false, "GET http://google.com/"},
+		{false, "GET https://google.com/"},
+		{false, "GET https://example.com/"},
+		{false, "CONNECT //www.google.com:8443"},
+		{false, "GET http://update.googleapis.com/service/update2/json"},
+	}
+
+	for _, tc := range testcases {
+		got := IsInternalChromeRequest(newInternalTestRequest(tc.urlStr))
+		if tc.expect != got {
+			t.Errorf("mismatch %s", tc.urlStr)
+		}
+	}
+}
+
+func TestInternalRequestLearner(t *testing.T) {
+	var (
+		idle    = true
+		learner = InternalRequestLearner{Idle: func() bool { return idle }}
+		pr      = Proxy{LearnInternal: &learner}
+	)
+
+	pr.SetInternalRequests(NewInternalRequestMatcher([]InternalRequestRule{
+		{Method: "CONNECT", Host: "*.gvt1.com"},
+	}))
+
+	for _, s := range []string{
+		"CONNECT //redirector.gvt1.com:443",
+		"CONNECT //accounts.google.com:443",
+		"CONNECT //accounts.google.com:443",
+		"GET http://example.com/beacon/1?n=1",
+		"GET http://example.com/beacon/2",
+	} {
+		blocked := pr.blockInternal(newInternalTestRequest(s))
+
+		if expect := strings.Contains(s, "gvt1.com"); blocked != expect {
+			t.Errorf("%s: blocked %v, expect %v", s, blocked, expect)
+		}
+	}
+
+	idle = false
+	pr.blockInternal(newInternalTestRequest("GET http://example.com/page"))
+
+	learned := learner.Learned()
+	if len(learned) != 2 {
+		t.Fatalf("got %+v", learned)
+	}
+
+	if lr := learned[0]; lr.Host != "accounts.google.com" || lr.Method != "CONNECT" || lr.Port != "443" || lr.Count != 2 {
+		t.Errorf("got %+v", lr)
+	}
+
+	if lr := learned[1]; lr.Host != "example.com" || lr.PathPrefix != "/beacon/" || lr.Scheme != "http" || lr.Count != 2 {
+		t.Errorf("got %+v", lr)
+	}
+
+	m := NewInternalRequestMatcher([]InternalRequestRule{learned[1].InternalRequestRule})
+	if !m.Match(newInternalTestRequest("GET http://example.com/beacon/3?n=2")) {
+		t.Errorf("learned rule does not match")
+	}
+
+	idle = true
+	for i := range maxLearnedRequests {
+		pr.blockInternal(newInternalTestRequest(fmt.Sprintf("GET http://host%d.example/", i)))
+	}
+
+	if n := len(learner.Learned()); n != maxLearnedRequests {
+		t.Errorf("%d learned, want at most %d", n, maxLearnedRequests)
+	}
+}
@@ -0,0 +1,69 @@
+package chromekiosk
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"path/filepath"
+)
+
+// Components log through *slog.Logger with these attributes, where they
+// apply: "component" (proxy, socks, browser or monitor), "url", "host",
+// "status", "duration", "target_id" and "err".
+//
+// NewLogHandler adapts an existing *log.Logger, so that the older Log,
+// ConsoleLog and TraceLog fields keep working: records at level or above
+// are formatted as text, without a time, and written through l with its
+// prefix and flags. As l cannot know where a record was logged, Lshortfile
+// and Llongfile are given as a source attribute instead.
+func NewLogHandler(l *log.Logger, level slog.Leveler) slog.Handler {
+	var (
+		flags  = l.Flags()
+		source = flags&(log.Lshortfile|log.Llongfile) != 0
+	)
+
+	if source {
+		l = log.New(l.Writer(), l.Prefix(), flags&^(log.Lshortfile|log.Llongfile))
+	}
+
+	return slog.NewTextHandler(logWriter{l}, &slog.HandlerOptions{
+		AddSource: source,
+		Level:     level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+
+			switch a.Key {
+			case slog.TimeKey:
+				return slog.Attr{}
+			case slog.SourceKey:
+				if src, ok := a.Value.Any().(*slog.Source); ok && flags&log.Lshortfile != 0 {
+					return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+			}
+			return a
+		},
+	})
+}
+
+type logWriter struct{ l *log.Logger }
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.l.Print(string(p))
+	return len(p), nil
+}
+
+// logger returns l, or else an adapter for legacy at level if set, or else
+// a logger that discards everything.
+func logger(l *slog.Logger, legacy *log.Logger, level slog.Leveler) *slog.Logger {
+	switch {
+	case l != nil:
+		return l
+	case legacy != nil:
+		return slog.New(NewLogHandler(legacy, level))
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
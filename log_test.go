@@ -0,0 +1,64 @@
+package chromekiosk
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyLogging(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	var buf bytes.Buffer
+
+	pr := Proxy{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	pr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/pot", nil))
+
+	var rec struct {
+		Msg       string
+		Component string
+		URL       string
+		Host      string
+		Status    int
+		Duration  *int64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%s: %s", err, buf.Bytes())
+	}
+
+	if rec.Msg != "request" || rec.Component != "proxy" || rec.URL != upstream.URL+"/pot" ||
+		rec.Host != "127.0.0.1" || rec.Status != http.StatusTeapot || rec.Duration == nil {
+		t.Errorf("got %s", buf.Bytes())
+	}
+
+	// The legacy *log.Logger field goes through NewLogHandler at Info, with
+	// the source of each record rather than of the handler.
+	buf.Reset()
+
+	pr = Proxy{Log: log.New(&buf, "kiosk: ", log.Lshortfile)}
+	pr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/pot", nil))
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "kiosk: level=INFO source=webproxy.go:") || strings.Contains(out, "time=") || strings.Count(out, "\n") != 1 ||
+		!strings.Contains(out, "msg=request component=proxy method=GET url="+upstream.URL+"/pot host=127.0.0.1 status=418") {
+		t.Errorf("got %s", out)
+	}
+
+	// At Debug, the start of each request is logged as well.
+	buf.Reset()
+
+	pr = Proxy{Logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	pr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", upstream.URL+"/pot", nil))
+
+	if out := buf.String(); !strings.Contains(out, `msg="request start"`) || !strings.Contains(out, "msg=request ") {
+		t.Errorf("got %s", out)
+	}
+}
@@ -0,0 +1,349 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics is a minimal registry of counters, gauges and histograms that
+// can be exposed in the Prometheus text format.
+type Metrics struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	writeText(w io.Writer)
+}
+
+var DefaultMetrics = &Metrics{}
+
+var (
+	DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+	metricProxyRequests        = DefaultMetrics.NewCounter("chromekiosk_proxy_requests_total", "Proxied requests by upstream host and status.", "host", "status")
+	metricProxyReceivedBytes   = DefaultMetrics.NewCounter("chromekiosk_proxy_received_bytes_total", "Bytes received from upstream.")
+	metricProxySentBytes       = DefaultMetrics.NewCounter("chromekiosk_proxy_sent_bytes_total", "Bytes sent to upstream.")
+	metricProxyUpstreamLatency = DefaultMetrics.NewHistogram("chromekiosk_proxy_upstream_latency_seconds", "Time until upstream response headers.", DefaultLatencyBuckets, "host")
+	metricProxyTunnels         = DefaultMetrics.NewGauge("chromekiosk_proxy_connect_tunnels_active", "Open CONNECT tunnels.")
+	metricProxyBlockedInternal = DefaultMetrics.NewCounter("chromekiosk_proxy_blocked_internal_requests_total", "Blocked internal Chrome requests.")
+
+	metricBrowserRestarts           = DefaultMetrics.NewCounter("chromekiosk_browser_restarts_total", "Browser restarts.")
+	metricBrowserNavigations        = DefaultMetrics.NewCounter("chromekiosk_browser_navigations_total", "Navigations requested.")
+	metricBrowserNavigationFailures = DefaultMetrics.NewCounter("chromekiosk_browser_navigation_failures_total", "Navigations that failed.")
+	metricBrowserEvalLatency        = DefaultMetrics.NewHistogram("chromekiosk_browser_evaljs_duration_seconds", "EvalJS latency.", DefaultLatencyBuckets)
+
+	metricMonitorStartTime     = DefaultMetrics.NewGauge("chromekiosk_monitor_start_time_seconds", "Unix time the monitor started running.")
+	metricMonitorBrowserErrors = DefaultMetrics.NewCounter("chromekiosk_monitor_browser_errors_total", "Browser runs that ended in an error.")
+)
+
+func (m *Metrics) register(mt metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metrics = append(m.metrics, mt)
+}
+
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	metrics := slices.Clone(m.metrics)
+	m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, mt := range metrics {
+		mt.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// metricFamily holds the values of one metric for each combination of
+// label values.
+type metricFamily[V any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*V
+	keys   map[string][]string
+}
+
+func (f *metricFamily[V]) get(labelValues []string, init func() *V) *V {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, expect %d", f.name, len(labelValues), len(f.labels)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	if v, ok := f.values[key]; ok {
+		return v
+	}
+
+	if f.values == nil {
+		f.values = make(map[string]*V)
+		f.keys = make(map[string][]string)
+	}
+
+	v := init()
+	f.values[key] = v
+	f.keys[key] = slices.Clone(labelValues)
+	return v
+}
+
+func (f *metricFamily[V]) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+}
+
+// each calls fn for every set of label values, in a stable order, with
+// the family locked.
+func (f *metricFamily[V]) each(fn func(labels string, v *V)) {
+	keys := make([]string, 0, len(f.values))
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		fn(formatLabels(f.labels, f.keys[k]), f.values[k])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1]))
+	}
+
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func newFloat() *float64 { return new(float64) }
+
+type Counter struct {
+	metricFamily[float64]
+}
+
+func (m *Metrics) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{metricFamily[float64]{name: name, help: help, typ: "counter", labels: labels}}
+	m.register(c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*c.get(labelValues, newFloat) += v
+}
+
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Value returns the current value for labelValues, or zero if it has never
+// been set.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return *v
+	}
+	return 0
+}
+
+func (c *Counter) writeText(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w)
+	c.each(func(labels string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(*v))
+	})
+}
+
+type Gauge struct {
+	Counter
+}
+
+func (m *Metrics) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{Counter{metricFamily[float64]{name: name, help: help, typ: "gauge", labels: labels}}}
+	m.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	*g.get(labelValues, newFloat) = v
+}
+
+func (g *Gauge) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	metricFamily[histogramValue]
+	buckets []float64
+}
+
+func (m *Metrics) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		metricFamily: metricFamily[histogramValue]{name: name, help: help, typ: "histogram", labels: labels},
+		buckets:      buckets,
+	}
+	m.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv := h.get(labelValues, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	})
+
+	for i, le := range h.buckets {
+		if v <= le {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) writeText(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		var (
+			hv          = h.values[k]
+			labelValues = h.keys[k]
+		)
+
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatFloat(le)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", "+Inf"), hv.count)
+
+		labels := formatLabels(h.labels, labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
+
+// maxMetricHosts bounds the number of distinct host labels, since every
+// site Chrome visits would otherwise become a new series.
+const maxMetricHosts = 100
+
+var metricHosts struct {
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+// hostLabel returns host as a metric label value, or "other" once
+// maxMetricHosts other hosts have been seen.
+func hostLabel(host string) string {
+	metricHosts.mu.Lock()
+	defer metricHosts.mu.Unlock()
+
+	if metricHosts.hosts[host] {
+		return host
+	}
+
+	if len(metricHosts.hosts) >= maxMetricHosts {
+		return "other"
+	}
+
+	if metricHosts.hosts == nil {
+		metricHosts.hosts = make(map[string]bool)
+	}
+	metricHosts.hosts[host] = true
+	return host
+}
+
+// meteredConn counts the bytes passing through an upstream connection.
+type meteredConn struct {
+	net.Conn
+}
+
+func (c meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	metricProxyReceivedBytes.Add(float64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	metricProxySentBytes.Add(float64(n))
+	return n, err
+}
+
+// meteredBody counts the bytes of a request body sent upstream, or of a
+// response body received from upstream, in c.
+type meteredBody struct {
+	io.ReadCloser
+	c *Counter
+}
+
+func (b meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.c.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,141 @@
+package chromekiosk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsText(t *testing.T) {
+	var m Metrics
+
+	c := m.NewCounter("test_requests_total", "Requests.", "host", "status")
+	c.Inc("a.example", "200")
+	c.Add(2, "a.example", "200")
+	c.Inc(`we"ird`, "502")
+
+	g := m.NewGauge("test_open", "Open things.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	h := m.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var sb strings.Builder
+	m.WriteText(&sb)
+
+	const expect = `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{host="a.example",status="200"} 3
+test_requests_total{host="we\"ird",status="502"} 1
+# HELP test_open Open things.
+# TYPE test_open gauge
+test_open 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+`
+
+	if got := sb.String(); got != expect {
+		t.Errorf("got:\n%s", got)
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	var (
+		pr = Proxy{Middleware: []ProxyMiddleware{&rewriteMiddleware{func(r io.Reader) io.Reader {
+			return io.MultiReader(r, strings.NewReader(" world"))
+		}}}}
+		before   = metricProxyRequests.Value("127.0.0.1", "200")
+		received = metricProxyReceivedBytes.Value()
+	)
+
+	r := httptest.NewRequest("GET", upstream.URL+"/", nil)
+	pr.ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := metricProxyRequests.Value("127.0.0.1", "200") - before; got != 1 {
+		t.Errorf("requests counted %v", got)
+	}
+
+	// Only what came from upstream, not what the middleware added.
+	if got := metricProxyReceivedBytes.Value() - received; got != float64(len("hello")) {
+		t.Errorf("received bytes %v", got)
+	}
+
+	if v := metricProxyRequests.Value("never.example", "200"); v != 0 || strings.Contains(textOf(DefaultMetrics), "never.example") {
+		t.Errorf("Value created a series")
+	}
+
+	for i := range maxMetricHosts {
+		hostLabel(fmt.Sprintf("host%d.example", i))
+	}
+	if got := hostLabel("one-too-many.example"); got != "other" {
+		t.Errorf("hostLabel past the limit: got %q", got)
+	}
+}
+
+func TestMonitorBrowserRestarts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		m      Monitor
+		runs   int
+		before = metricBrowserRestarts.Value()
+		errs   = metricMonitorBrowserErrors.Value()
+	)
+
+	run := func(ctx context.Context) error {
+		if runs++; runs == 3 {
+			cancel()
+			return ctx.Err()
+		}
+		return errors.New("crashed")
+	}
+
+	if err := m.superviseBrowser(ctx, run, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := metricBrowserRestarts.Value() - before; got != 2 {
+		t.Errorf("restarts counted %v", got)
+	}
+
+	if got := metricMonitorBrowserErrors.Value() - errs; got != 2 {
+		t.Errorf("errors counted %v", got)
+	}
+}
+
+type rewriteMiddleware struct {
+	fn func(io.Reader) io.Reader
+}
+
+func (m *rewriteMiddleware) ModifyRequest(req *http.Request) error { return nil }
+
+func (m *rewriteMiddleware) ModifyResponse(resp *http.Response) error {
+	return RewriteBody(resp, m.fn)
+}
+
+func textOf(m *Metrics) string {
+	var sb strings.Builder
+	m.WriteText(&sb)
+	return sb.String()
+}
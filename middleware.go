@@ -0,0 +1,299 @@
+package chromekiosk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// A ProxyMiddleware inspects and modifies requests before they are
+// forwarded upstream and responses before they are returned to Chrome.
+// Middlewares run in order; an error aborts the request with a 502.
+type ProxyMiddleware interface {
+	ModifyRequest(req *http.Request) error
+	ModifyResponse(resp *http.Response) error
+}
+
+func (pr *Proxy) modifyRequest(req *http.Request) error {
+	for _, mw := range pr.Middleware {
+		if err := mw.ModifyRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pr *Proxy) modifyResponse(resp *http.Response) error {
+	for _, mw := range pr.Middleware {
+		if err := mw.ModifyResponse(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HeaderMiddleware sets and removes request and response headers for hosts
+// matching Hosts, or for every host if Hosts is empty.
+type HeaderMiddleware struct {
+	Hosts          []string
+	SetRequest     http.Header
+	RemoveRequest  []string
+	SetResponse    http.Header
+	RemoveResponse []string
+}
+
+// StripFramingHeaders returns a middleware that removes the headers which
+// stop pages from being framed by a kiosk dashboard.
+func StripFramingHeaders(hosts ...string) *HeaderMiddleware {
+	return &HeaderMiddleware{
+		Hosts: hosts,
+		RemoveResponse: []string{
+			"X-Frame-Options",
+			"Content-Security-Policy",
+			"Content-Security-Policy-Report-Only",
+		},
+	}
+}
+
+func (m *HeaderMiddleware) match(req *http.Request) bool {
+	return len(m.Hosts) == 0 || matchHostGlobs(m.Hosts, strings.ToLower(req.URL.Hostname()))
+}
+
+func (m *HeaderMiddleware) ModifyRequest(req *http.Request) error {
+	if m.match(req) {
+		editHeader(req.Header, m.SetRequest, m.RemoveRequest)
+	}
+	return nil
+}
+
+func (m *HeaderMiddleware) ModifyResponse(resp *http.Response) error {
+	if m.match(resp.Request) {
+		editHeader(resp.Header, m.SetResponse, m.RemoveResponse)
+	}
+	return nil
+}
+
+func editHeader(hdr, set http.Header, remove []string) {
+	for _, k := range remove {
+		hdr.Del(k)
+	}
+
+	for k, vs := range set {
+		hdr[http.CanonicalHeaderKey(k)] = vs
+	}
+}
+
+// HeadInjectMiddleware inserts HTML, such as a <style> or <script> tag,
+// just after the opening <head> tag of HTML pages from matching hosts.
+type HeadInjectMiddleware struct {
+	Hosts []string
+	HTML  string
+}
+
+func (m *HeadInjectMiddleware) match(req *http.Request) bool {
+	return len(m.Hosts) == 0 || matchHostGlobs(m.Hosts, strings.ToLower(req.URL.Hostname()))
+}
+
+func (m *HeadInjectMiddleware) ModifyRequest(req *http.Request) error {
+	if m.match(req) && req.Header.Get("Accept-Encoding") != "" {
+		// Only ask for encodings that RewriteBody can undo.
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	return nil
+}
+
+func (m *HeadInjectMiddleware) ModifyResponse(resp *http.Response) error {
+	if !m.match(resp.Request) || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return nil
+	}
+
+	return RewriteBody(resp, func(r io.Reader) io.Reader {
+		return &headInjector{r: r, inject: []byte(m.HTML)}
+	})
+}
+
+// RewriteBody replaces the body of resp with the output of fn, which is
+// given the decoded body. Bodies with gzip or deflate Content-Encoding are
+// decoded first; the rewritten body is sent without Content-Encoding, and
+// without Content-Length since its length is not known in advance.
+// Responses that have no body, such as to HEAD requests, are left alone.
+func RewriteBody(resp *http.Response, fn func(io.Reader) io.Reader) error {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.ContentLength == 0 {
+		return nil
+	}
+
+	var (
+		body = resp.Body
+		r    io.Reader
+	)
+
+	switch enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		r = body
+
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err == io.EOF {
+			r = http.NoBody
+		} else if err != nil {
+			return fmt.Errorf("RewriteBody: %w", err)
+		} else {
+			r = zr
+		}
+
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err == io.EOF {
+			r = http.NoBody
+		} else if err != nil {
+			return fmt.Errorf("RewriteBody: %w", err)
+		} else {
+			r = zr
+		}
+
+	default:
+		return fmt.Errorf("RewriteBody: unsupported Content-Encoding %q", enc)
+	}
+
+	resp.Body = readCloser{fn(r), body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+const headScanLimit = 64 << 10
+
+// headInjector buffers the start of an HTML document until it can find
+// where to insert its payload: after <head>, failing that before <body>,
+// failing that after <html>, and otherwise at the very start.
+type headInjector struct {
+	r      io.Reader
+	inject []byte
+	buf    []byte
+	done   bool
+	err    error
+}
+
+func (h *headInjector) Read(p []byte) (int, error) {
+	for !h.done {
+		if h.resolve(h.err != nil || len(h.buf) >= headScanLimit) {
+			break
+		}
+
+		var chunk [4096]byte
+		n, err := h.r.Read(chunk[:])
+		h.buf = append(h.buf, chunk[:n]...)
+		h.err = err
+	}
+
+	if len(h.buf) > 0 {
+		n := copy(p, h.buf)
+		h.buf = h.buf[n:]
+		return n, nil
+	}
+
+	if h.err != nil {
+		return 0, h.err
+	}
+
+	return h.r.Read(p)
+}
+
+func (h *headInjector) resolve(final bool) bool {
+	lower := bytes.ToLower(h.buf)
+
+	if at, ok := tagEnd(lower, "<head"); ok {
+		return h.insertAt(at)
+	} else if at < 0 {
+		// Saw the start of <head but not its end yet.
+		if !final {
+			return false
+		}
+	}
+
+	if at := tagStart(lower, "<body"); at >= 0 {
+		return h.insertAt(at)
+	}
+
+	if !final {
+		return false
+	}
+
+	if at, ok := tagEnd(lower, "<html"); ok {
+		return h.insertAt(at)
+	}
+
+	return h.insertAt(0)
+}
+
+func (h *headInjector) insertAt(at int) bool {
+	buf := make([]byte, 0, len(h.buf)+len(h.inject))
+	buf = append(buf, h.buf[:at]...)
+	buf = append(buf, h.inject...)
+	buf = append(buf, h.buf[at:]...)
+
+	h.buf = buf
+	h.done = true
+	return true
+}
+
+// tagStart returns the offset of the first opening tag named by prefix
+// (e.g. "<head") in buf, or -1.
+func tagStart(buf []byte, prefix string) int {
+	off := 0
+	for {
+		i := bytes.Index(buf[off:], []byte(prefix))
+		if i < 0 {
+			return -1
+		}
+
+		i += off
+		end := i + len(prefix)
+		if end >= len(buf) {
+			return -1
+		}
+
+		switch buf[end] {
+		case '>', ' ', '\t', '\n', '\r', '/':
+			return i
+		}
+
+		off = end
+	}
+}
+
+// tagEnd returns the offset just past the opening tag named by prefix. If
+// the tag has started but not yet ended, it returns -1; if there is no such
+// tag, it returns 0. Either way ok is false.
+func tagEnd(buf []byte, prefix string) (at int, ok bool) {
+	i := tagStart(buf, prefix)
+	if i < 0 {
+		return 0, false
+	}
+
+	gt := bytes.IndexByte(buf[i:], '>')
+	if gt < 0 {
+		return -1, false
+	}
+
+	return i + gt + 1, true
+}
@@ -0,0 +1,125 @@
+package chromekiosk
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHeadInjector(t *testing.T) {
+	const inject = "<style>*{cursor:none}</style>"
+
+	var testcases = []struct {
+		in, out string
+	}{
+		{"<html><head><title>x</title></head></html>", "<html><head>" + inject + "<title>x</title></head></html>"},
+		{"<!DOCTYPE html><HTML><HEAD lang=en>x", "<!DOCTYPE html><HTML><HEAD lang=en>" + inject + "x"},
+		{"<html><header></header><body>y</body>", "<html><header></header>" + inject + "<body>y</body>"},
+		{"<html>text", "<html>" + inject + "text"},
+		{"text", inject + "text"},
+		{"", inject},
+	}
+
+	for _, tc := range testcases {
+		h := &headInjector{r: iotest.OneByteReader(strings.NewReader(tc.in)), inject: []byte(inject)}
+
+		out, err := io.ReadAll(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(out); got != tc.out {
+			t.Errorf("%q: got %q", tc.in, got)
+		}
+	}
+}
+
+func TestProxyMiddleware(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("Content-Type", "text/html; charset=utf-8")
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Set("X-Frame-Options", "DENY")
+		hdr.Set("X-Seen-Token", r.Header.Get("X-Token"))
+
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, "<html><head><title>dash</title></head><body></body></html>")
+		zw.Close()
+	}))
+	defer upstream.Close()
+
+	var pr = Proxy{
+		Middleware: []ProxyMiddleware{
+			StripFramingHeaders(),
+			&HeaderMiddleware{SetRequest: http.Header{"X-Token": {"secret"}}},
+			&HeadInjectMiddleware{Hosts: []string{"127.0.0.1"}, HTML: `<script src="/kiosk.js"></script>`},
+		},
+	}
+
+	r := httptest.NewRequest("GET", upstream.URL+"/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, r)
+
+	resp := w.Result()
+
+	if v := resp.Header.Get("X-Frame-Options"); v != "" {
+		t.Errorf("X-Frame-Options not removed: %q", v)
+	}
+
+	if v := resp.Header.Get("X-Seen-Token"); v != "secret" {
+		t.Errorf("request header not set: %q", v)
+	}
+
+	if v := resp.Header.Get("Content-Encoding"); v != "" {
+		t.Errorf("Content-Encoding %q", v)
+	}
+
+	const expect = `<html><head><script src="/kiosk.js"></script><title>dash</title></head><body></body></html>`
+	if got := w.Body.String(); got != expect {
+		t.Errorf("body %q", got)
+	}
+}
+
+func TestRewriteBodyEmpty(t *testing.T) {
+	upper := func(r io.Reader) io.Reader {
+		b, _ := io.ReadAll(r)
+		return strings.NewReader(strings.ToUpper(string(b)) + "!")
+	}
+
+	var testcases = []struct {
+		method string
+		status int
+		length int64
+		out    string
+	}{
+		{"HEAD", http.StatusOK, -1, ""},
+		{"GET", http.StatusNoContent, -1, ""},
+		{"GET", http.StatusNotModified, -1, ""},
+		{"GET", http.StatusOK, 0, ""},
+		{"GET", http.StatusOK, -1, "!"},
+	}
+
+	for _, tc := range testcases {
+		resp := &http.Response{
+			StatusCode:    tc.status,
+			Header:        http.Header{"Content-Encoding": {"gzip"}},
+			Body:          http.NoBody,
+			ContentLength: tc.length,
+			Request:       httptest.NewRequest(tc.method, "/", nil),
+		}
+
+		if err := RewriteBody(resp, upper); err != nil {
+			t.Errorf("%s %d: %s", tc.method, tc.status, err)
+			continue
+		}
+
+		if out, _ := io.ReadAll(resp.Body); string(out) != tc.out {
+			t.Errorf("%s %d: got %q", tc.method, tc.status, out)
+		}
+	}
+}
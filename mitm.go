@@ -0,0 +1,129 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// intercept terminates TLS from the client on conn and feeds the decrypted
+// requests through ServeHTTP as if they were plain proxy requests for
+// https://authority. Clients that do not open with a TLS handshake are
+// tunnelled to upstream untouched.
+func (pr *Proxy) intercept(ctx context.Context, conn net.Conn, bufr *bufio.Reader, authority string) {
+	conn = &bufConn{Conn: conn, r: bufr}
+
+	if b, err := bufr.Peek(1); err != nil {
+		conn.Close()
+		return
+	} else if b[0] != 0x16 {
+		pr.tunnel(ctx, conn, authority)
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(authority)
+	if port == "443" {
+		authority = host
+	}
+
+	var (
+		tlsConfig = &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				name := hello.ServerName
+				if name == "" {
+					name = host
+				}
+				return pr.CA.Certificate(name)
+			},
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		ln   = newTLSConnListener(conn, tlsConfig)
+		serv = http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.URL.Scheme = "https"
+				r.URL.Host = authority
+				pr.ServeHTTP(w, r)
+			}),
+			ErrorLog:    pr.errorLog(),
+			BaseContext: func(net.Listener) context.Context { return ctx },
+			ConnState: func(_ net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					ln.Close()
+				}
+			},
+		}
+	)
+
+	serv.Serve(ln)
+}
+
+func (pr *Proxy) tunnel(ctx context.Context, conn net.Conn, addr string) {
+	defer conn.Close()
+
+	upconn, err := pr.dialTarget(ctx, addr)
+	if err != nil {
+		pr.logger("proxy").Warn("dial", "method", http.MethodConnect, "host", addr, "err", err)
+		return
+	}
+
+	teeConn(conn, meteredConn{upconn})
+}
+
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// connListener is a net.Listener that yields a single connection, and then
+// blocks further calls to Accept until it is closed, which happens when the
+// connection is, even if it has been hijacked.
+type connListener struct {
+	conn  net.Conn
+	once  sync.Once
+	connc chan net.Conn
+	donec chan struct{}
+}
+
+// newTLSConnListener returns a connListener for the server side of a TLS
+// connection over conn. The *tls.Conn is yielded as is, so that
+// http.Server can negotiate HTTP/2 on it.
+func newTLSConnListener(conn net.Conn, config *tls.Config) *connListener {
+	ln := &connListener{
+		connc: make(chan net.Conn, 1),
+		donec: make(chan struct{}),
+	}
+	ln.conn = tls.Server(&closeNotifyConn{Conn: conn, ln: ln}, config)
+	ln.connc <- ln.conn
+	return ln
+}
+
+func (ln *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connc:
+		return conn, nil
+	case <-ln.donec:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *connListener) Close() error {
+	ln.once.Do(func() { close(ln.donec) })
+	return nil
+}
+
+func (ln *connListener) Addr() net.Addr { return ln.conn.LocalAddr() }
+
+type closeNotifyConn struct {
+	net.Conn
+	ln *connListener
+}
+
+func (c *closeNotifyConn) Close() error {
+	c.ln.Close()
+	return c.Conn.Close()
+}
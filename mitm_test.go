@@ -0,0 +1,230 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestProxyIntercept(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{
+		Transport: upstream.Client().Transport,
+		Intercept: true,
+		CA:        ca,
+	}
+	pr.SetPolicy(&Policy{
+		Rules: []PolicyRule{{Action: PolicyDeny, Paths: []string{"/private"}}},
+	})
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyUrl),
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	resp, err := client.Get(upstream.URL + "/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if got := string(body); got != "hello /public" {
+		t.Errorf("got %q", got)
+	}
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("intercepted over %s, want HTTP/2", resp.Proto)
+	}
+
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].Issuer.CommonName != ca.Root().Leaf.Subject.CommonName {
+		t.Errorf("response not signed by proxy CA")
+	}
+
+	resp, err = client.Get(upstream.URL + "/private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("intercepted policy: got %d", resp.StatusCode)
+	}
+}
+
+func TestLoadCertAuthority(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := LoadCertAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := LoadCertAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.Root().Leaf.Equal(again.Root().Leaf) {
+		t.Fatalf("CA not persisted")
+	}
+
+	if renewed, err := again.Renew(); err != nil || renewed {
+		t.Fatalf("fresh CA renewed: %v %v", renewed, err)
+	}
+
+	leaf, err := again.Certificate("kiosk.localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "kiosk.localhost", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertAuthorityLeafCache(t *testing.T) {
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := ca.Certificate("host0.test")
+
+	for i := 1; i <= maxLeafCerts; i++ {
+		if i == maxLeafCerts/2 {
+			ca.Certificate("host0.test") // Keep it recently used.
+		}
+		ca.Certificate(fmt.Sprintf("host%d.test", i))
+	}
+
+	if again, _ := ca.Certificate("host0.test"); again != first {
+		t.Errorf("recently used leaf evicted")
+	}
+
+	if ca.leafList.Len() != maxLeafCerts {
+		t.Errorf("%d leafs cached, want %d", ca.leafList.Len(), maxLeafCerts)
+	}
+
+	if _, ok := ca.leafs["host1.test"]; ok {
+		t.Errorf("least recently used leaf kept")
+	}
+}
+
+func TestProxyInterceptUpgrade(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer upstream.Close()
+
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{
+		Transport: upstream.Client().Transport,
+		Intercept: true,
+		CA:        ca,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go runTLSProxy(ctx, ln, &pr, ca)
+	defer ln.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	// An HTTP/2 CONNECT stream, intercepted, carrying an upgrade.
+	reqr, reqw := io.Pipe()
+	defer reqw.Close()
+
+	req, _ := http.NewRequest("CONNECT", "https://"+ln.Addr().String(), reqr)
+	req.Host = upstream.Listener.Addr().String()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: got %s %s", resp.Proto, resp.Status)
+	}
+
+	c1, c2 := net.Pipe()
+	go io.Copy(reqw, c2)
+	go io.Copy(c2, resp.Body)
+
+	conn := tls.Client(c1, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: []string{"http/1.1"}})
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+req.Host+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	bufr := bufio.NewReader(conn)
+	uresp, err := http.ReadResponse(bufr, nil)
+	if err != nil || uresp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: got %v %v", uresp, err)
+	}
+
+	// The tunnel outlives the hijack of the intercepted connection.
+	time.Sleep(50 * time.Millisecond)
+
+	io.WriteString(conn, "ping")
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(bufr, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo: got %q %v", buf, err)
+	}
+}
@@ -1,11 +1,15 @@
 package chromekiosk
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"time"
 )
@@ -17,23 +21,48 @@ type Monitor struct {
 	MountPoint   string
 	RunDir       string
 
+	// ImageVersion is reported by the kiosk.localhost status page; if
+	// empty, it is read from os-release in the container once it has been
+	// created.
+	ImageVersion string
+
+	// If SOCKSProxy is set, Chrome sends traffic other than HTTP, HTTPS and
+	// WebSockets through a SOCKS5 server on the ProxyHandler, which must
+	// then be a *Proxy.
+	SOCKSProxy bool
+
+	// Logger is used by the monitor and browser; if nil, slog.Default().
+	Logger *slog.Logger
+
 	Browser Browser
 	Con     Container
+	CA      *CertAuthority
 
 	proxyListener net.Listener
+	socksListener net.Listener
+	proxy         *Proxy
+	startTime     time.Time
 
 	browserErrc chan error
 }
 
 const (
-	CageBin = "/usr/bin/cage"
+	CageBin     = "/usr/bin/cage"
+	CertutilBin = "/usr/bin/certutil"
 
 	envPath         = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 	xdgRuntimeDir   = "/run"
 	userHome        = "/run/home"
 	chromeDataDir   = "/run/chrome-data"
+	chromeNssDir    = userHome + "/.pki/nssdb"
 	proxyListenAddr = "127.0.0.1:8443"
 	proxyListenUrl  = "https://" + proxyListenAddr
+	socksListenAddr = "127.0.0.1:1080"
+	socksListenUrl  = "socks5://" + socksListenAddr
+
+	caRenewInterval = 12 * time.Hour
+
+	browserRestartDelay = 5 * time.Second
 )
 
 func (m *Monitor) Init() error {
@@ -51,11 +80,19 @@ func (m *Monitor) Init() error {
 		m.StartUrl = "blank:black"
 	}
 
+	proxyServer := proxyListenUrl
+	if m.SOCKSProxy {
+		proxyServer = "http=" + proxyListenUrl + ";https=" + proxyListenUrl + ";socks=" + socksListenUrl
+	}
+
 	*m = Monitor{
 		ProxyHandler: m.ProxyHandler,
 		ImagePath:    m.ImagePath,
 		MountPoint:   m.MountPoint,
 		RunDir:       m.RunDir,
+		SOCKSProxy:   m.SOCKSProxy,
+		ImageVersion: m.ImageVersion,
+		Logger:       m.Logger,
 
 		Browser: Browser{
 			StartUrl: m.StartUrl,
@@ -65,7 +102,7 @@ func (m *Monitor) Init() error {
 			ExecArgsPrefix: []string{CageBin, "--"},
 
 			ExtraFlags: BrowserFlags{
-				"proxy-server": proxyListenUrl,
+				"proxy-server": proxyServer,
 			},
 
 			CmdEnviron: []string{
@@ -75,7 +112,7 @@ func (m *Monitor) Init() error {
 				"WLR_LIBINPUT_NO_DEVICES=1",
 			},
 
-			ConsoleLog: log.Default(),
+			Logger: cmp.Or(m.Logger, slog.Default()),
 		},
 
 		Con: Container{
@@ -111,12 +148,25 @@ func (m *Monitor) Run(ctx context.Context) error {
 
 	go func() {
 		// FIXME
-		err := runTLSProxy(ctx, m.proxyListener, m.ProxyHandler)
+		err := runTLSProxy(ctx, m.proxyListener, m.ProxyHandler, m.CA)
 		if err != nil {
-			log.Printf("runTLSProxy: %s", err)
+			m.logger().Error("proxy stopped", "err", err)
 		}
 	}()
 
+	if m.socksListener != nil {
+		go func() {
+			if err := m.proxy.ServeSOCKS(ctx, m.socksListener); err != nil {
+				m.logger().Error("SOCKS proxy stopped", "err", err)
+			}
+		}()
+	}
+
+	go m.runCARenewal(ctx)
+
+	m.startTime = time.Now()
+	metricMonitorStartTime.Set(float64(m.startTime.Unix()))
+
 	go m.runBrowser(ctx)
 
 	var (
@@ -129,7 +179,7 @@ func (m *Monitor) Run(ctx context.Context) error {
 			return nil
 
 		case err := <-m.browserErrc:
-			log.Printf("browser error: %s", err)
+			m.logger().Error("browser stopped", "err", err)
 			m.browserErrc = nil
 			return err
 		}
@@ -143,10 +193,74 @@ func (m *Monitor) setup() error {
 		return err
 	}
 
+	if m.CA == nil {
+		ca, err := LoadCertAuthority(filepath.Join(m.RunDir, "ca"))
+		if err != nil {
+			return err
+		}
+
+		m.CA = ca
+	}
+
+	pr, ok := m.ProxyHandler.(*Proxy)
+	if !ok && m.ProxyHandler == nil {
+		pr = &DefaultProxyHandler
+	}
+
+	if pr != nil {
+		if pr.CA == nil {
+			pr.CA = m.CA
+		}
+
+		if c := pr.Cache; c != nil && c.Dir == "" {
+			c.Dir = filepath.Join(m.RunDir, "cache")
+		}
+
+		if j := pr.Cookies; j != nil && j.File == "" {
+			j.File = filepath.Join(m.RunDir, "cookies.json")
+		}
+	}
+
+	if m.SOCKSProxy && pr == nil {
+		return fmt.Errorf("SOCKSProxy requires a *Proxy ProxyHandler, not %T", m.ProxyHandler)
+	}
+
+	m.proxy = pr
+
+	if pr != nil {
+		if err := pr.compileHostMap(); err != nil {
+			return fmt.Errorf("HostMap: %w", err)
+		}
+	}
+
+	if pr != nil && pr.LearnInternal != nil && pr.LearnInternal.Idle == nil {
+		pr.LearnInternal.Idle = func() bool { return !m.Browser.Loading() }
+	}
+
+	if pr != nil && pr.vhost(statusHost) == nil {
+		pr.handlePlain(statusHost, m.statusHandler(pr))
+	}
+
 	if err := m.Con.Create(); err != nil {
 		return err
 	}
 
+	if m.ImageVersion == "" {
+		m.Con.Do(func() error {
+			m.ImageVersion = readImageVersion("/etc/os-release")
+			return nil
+		})
+	}
+
+	if err := m.installCA(); errors.Is(err, errNoCertutil) {
+		// Without certutil, Chrome cannot be told to trust the proxy CA, so
+		// fall back to not verifying certificates at all.
+		m.logger().Warn("proxy CA not installed, ignoring certificate errors", "err", err)
+		m.Browser.Flags["ignore-certificate-errors"] = true
+	} else if err != nil {
+		return err
+	}
+
 	err := m.Con.Do(func() error {
 		ln, err := net.Listen("tcp", proxyListenAddr)
 		if err != nil {
@@ -154,6 +268,16 @@ func (m *Monitor) setup() error {
 		}
 
 		m.proxyListener = ln
+
+		if m.SOCKSProxy {
+			ln, err := net.Listen("tcp", socksListenAddr)
+			if err != nil {
+				return err
+			}
+
+			m.socksListener = ln
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -163,6 +287,78 @@ func (m *Monitor) setup() error {
 	return nil
 }
 
+// installCA adds the proxy root certificate to the NSS database that Chrome
+// consults inside the container, so that the proxy listener and intercepted
+// tunnels validate without ignore-certificate-errors.
+func (m *Monitor) installCA() error {
+	var (
+		certPem  = m.CA.RootPEM()
+		certFile = filepath.Join(chromeNssDir, "chromekiosk-ca.pem")
+		dbDir    = "sql:" + chromeNssDir
+	)
+
+	return m.Con.Do(func() error {
+		if err := mkdirAll(chromeNssDir, 0o700); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(certFile, certPem, 0o644); err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(CertutilBin); err != nil {
+			return fmt.Errorf("%w: %w", errNoCertutil, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(chromeNssDir, "cert9.db")); err != nil {
+			if err := runCertutil("-N", "-d", dbDir, "--empty-password"); err != nil {
+				return err
+			}
+		}
+
+		return runCertutil("-A", "-d", dbDir, "-n", "chromekiosk", "-t", "C,,", "-i", certFile)
+	})
+}
+
+var errNoCertutil = errors.New("certutil not found")
+
+func runCertutil(args ...string) error {
+	cmd := exec.Command(CertutilBin, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("certutil %s: %w: %s", args[0], err, out)
+	}
+	return nil
+}
+
+func (m *Monitor) logger() *slog.Logger {
+	return cmp.Or(m.Logger, slog.Default()).With("component", "monitor")
+}
+
+func (m *Monitor) runCARenewal(ctx context.Context) {
+	ticker := time.NewTicker(caRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			renewed, err := m.CA.Renew()
+			if err != nil {
+				m.logger().Warn("CA renew", "err", err)
+				continue
+			}
+
+			if renewed {
+				if err := m.installCA(); err != nil {
+					m.logger().Warn("CA install", "err", err)
+				}
+			}
+		}
+	}
+}
+
 func (m *Monitor) runBrowser(ctx context.Context) (err error) {
 	defer func() {
 		m.browserErrc <- err
@@ -173,7 +369,29 @@ func (m *Monitor) runBrowser(ctx context.Context) (err error) {
 		return err
 	}
 
-	return m.Browser.Run(ctx)
+	return m.superviseBrowser(ctx, m.Browser.Run, browserRestartDelay)
+}
+
+// superviseBrowser calls run until ctx is done, restarting it after delay
+// whenever it returns.
+func (m *Monitor) superviseBrowser(ctx context.Context, run func(context.Context) error, delay time.Duration) error {
+	for {
+		err := run(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			metricMonitorBrowserErrors.Inc()
+		}
+		m.logger().Error("browser error, restarting", "err", err, "delay", delay)
+
+		if sleepCtx(ctx, delay) != nil {
+			return nil
+		}
+
+		metricBrowserRestarts.Inc()
+	}
 }
 
 const dialRemoteTimeout = 2 * time.Second
@@ -0,0 +1,224 @@
+package chromekiosk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+type PolicyAction int
+
+const (
+	PolicyAllow PolicyAction = iota
+	PolicyDeny
+	PolicyRedirect
+)
+
+var policyActionNames = []string{
+	PolicyAllow:    "allow",
+	PolicyDeny:     "deny",
+	PolicyRedirect: "redirect",
+}
+
+func (a PolicyAction) String() string {
+	if int(a) < len(policyActionNames) {
+		return policyActionNames[a]
+	}
+	return fmt.Sprintf("PolicyAction(%d)", int(a))
+}
+
+func (a PolicyAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *PolicyAction) UnmarshalText(text []byte) error {
+	n := slices.Index(policyActionNames, strings.ToLower(string(text)))
+	if n < 0 {
+		return fmt.Errorf("unknown policy action %q", text)
+	}
+	*a = PolicyAction(n)
+	return nil
+}
+
+// A PolicyRule matches when every non-empty criterion matches. Hosts are glob
+// patterns (see [path.Match]), so "*.example.com" matches any subdomain. Path
+// prefixes never match CONNECT requests, whose path is not visible to the
+// proxy unless the tunnel is intercepted.
+type PolicyRule struct {
+	Action   PolicyAction `json:"action"`
+	Hosts    []string     `json:"hosts,omitempty"`
+	Schemes  []string     `json:"schemes,omitempty"`
+	Ports    []string     `json:"ports,omitempty"`
+	Paths    []string     `json:"paths,omitempty"`
+	Methods  []string     `json:"methods,omitempty"`
+	Redirect string       `json:"redirect,omitempty"`
+}
+
+// Policy is an ordered list of rules; the first matching rule decides, and
+// requests matching no rule get the Default action.
+type Policy struct {
+	Rules    []PolicyRule `json:"rules"`
+	Default  PolicyAction `json:"default"`
+	Redirect string       `json:"redirect,omitempty"`
+}
+
+func ReadPolicyFile(name string) (*Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", name, err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", name, err)
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	for i, rule := range p.Rules {
+		for _, pat := range rule.Hosts {
+			if _, err := path.Match(pat, ""); err != nil {
+				return fmt.Errorf("rule %d: host %q: %w", i, pat, err)
+			}
+		}
+
+		if rule.Action == PolicyRedirect && rule.Redirect == "" && p.Redirect == "" {
+			return fmt.Errorf("rule %d: redirect without target", i)
+		}
+	}
+
+	if p.Default == PolicyRedirect && p.Redirect == "" {
+		return fmt.Errorf("default redirect without target")
+	}
+
+	return nil
+}
+
+// Decide returns the action for r and, for PolicyRedirect, the target URL.
+func (p *Policy) Decide(r *http.Request) (PolicyAction, string) {
+	if p == nil {
+		return PolicyAllow, ""
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.Match(r) {
+			continue
+		}
+
+		if rule.Action == PolicyRedirect && rule.Redirect != "" {
+			return rule.Action, rule.Redirect
+		}
+		return rule.Action, p.Redirect
+	}
+
+	return p.Default, p.Redirect
+}
+
+func (rule *PolicyRule) Match(r *http.Request) bool {
+	scheme, host, port := requestTarget(r)
+
+	if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(m string) bool { return strings.EqualFold(m, r.Method) }) {
+		return false
+	}
+
+	if len(rule.Schemes) > 0 && !slices.ContainsFunc(rule.Schemes, func(s string) bool { return strings.EqualFold(s, scheme) }) {
+		return false
+	}
+
+	if len(rule.Ports) > 0 && !slices.Contains(rule.Ports, port) {
+		return false
+	}
+
+	if len(rule.Hosts) > 0 && !matchHostGlobs(rule.Hosts, host) {
+		return false
+	}
+
+	if len(rule.Paths) > 0 {
+		if r.Method == http.MethodConnect {
+			return false
+		}
+
+		urlPath := r.URL.Path
+		if urlPath == "" {
+			urlPath = "/"
+		}
+
+		if !slices.ContainsFunc(rule.Paths, func(prefix string) bool { return strings.HasPrefix(urlPath, prefix) }) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestTarget returns the scheme, lower-cased hostname and port that a
+// proxied request is addressed to, filling in defaults where the request
+// leaves them implicit.
+func requestTarget(r *http.Request) (scheme, host, port string) {
+	u := r.URL
+	scheme = strings.ToLower(u.Scheme)
+
+	if r.Method == http.MethodConnect {
+		scheme = "https"
+	} else if scheme == "" {
+		scheme = "http"
+	}
+
+	hostport := u.Host
+	if hostport == "" {
+		hostport = r.Host
+	}
+
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		host, port = h, p
+	} else {
+		host = strings.Trim(hostport, "[]")
+	}
+
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	default:
+		return "80"
+	}
+}
+
+func matchHostGlobs(patterns []string, host string) bool {
+	for _, pat := range patterns {
+		if matchHostGlob(pat, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHostGlob(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == host {
+		return true
+	}
+
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
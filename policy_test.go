@@ -0,0 +1,93 @@
+package chromekiosk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	var p = Policy{
+		Rules: []PolicyRule{
+			{Action: PolicyDeny, Hosts: []string{"ads.example.com"}},
+			{Action: PolicyRedirect, Hosts: []string{"*.social.com"}, Redirect: "http://kiosk.localhost/blocked"},
+			{Action: PolicyAllow, Hosts: []string{"*.example.com", "example.com"}, Schemes: []string{"https"}},
+			{Action: PolicyAllow, Hosts: []string{"dash.local"}, Ports: []string{"8080"}, Paths: []string{"/board/"}, Methods: []string{"GET"}},
+		},
+		Default: PolicyDeny,
+	}
+
+	var testcases = []struct {
+		method string
+		urlStr string
+		expect PolicyAction
+	}{
+		{"GET", "https://www.example.com/", PolicyAllow},
+		{"CONNECT", "a.b.example.com:443", PolicyAllow},
+		{"GET", "http://www.example.com/", PolicyDeny},
+		{"GET", "https://ads.example.com/", PolicyDeny},
+		{"GET", "http://www.social.com/feed", PolicyRedirect},
+		{"GET", "http://dash.local:8080/board/1", PolicyAllow},
+		{"POST", "http://dash.local:8080/board/1", PolicyDeny},
+		{"GET", "http://dash.local/board/1", PolicyDeny},
+		{"GET", "http://dash.local:8080/admin", PolicyDeny},
+		{"CONNECT", "dash.local:8080", PolicyDeny},
+		{"GET", "http://other.org/", PolicyDeny},
+	}
+
+	for _, tc := range testcases {
+		r := httptest.NewRequest(tc.method, tc.urlStr, nil)
+		if got, _ := p.Decide(r); got != tc.expect {
+			t.Errorf("%s %s: got %s, expect %s", tc.method, tc.urlStr, got, tc.expect)
+		}
+	}
+}
+
+func TestProxyPolicyReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	var (
+		pr   Proxy
+		name = filepath.Join(t.TempDir(), "policy.json")
+	)
+
+	do := func() int {
+		r := httptest.NewRequest("GET", upstream.URL+"/", nil)
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("no policy: got %d", code)
+	}
+
+	if err := os.WriteFile(name, []byte(`{"default": "deny"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pr.LoadPolicyFile(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := do(); code != http.StatusForbidden {
+		t.Fatalf("deny policy: got %d", code)
+	}
+
+	if err := os.WriteFile(name, []byte(`{"rules": [{"action": "allow", "hosts": ["127.0.0.1"]}], "default": "redirect", "redirect": "http://kiosk.localhost/"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pr.LoadPolicyFile(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("allow policy: got %d", code)
+	}
+}
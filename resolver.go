@@ -0,0 +1,642 @@
+package chromekiosk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver resolves the hostnames of direct upstream connections, in place
+// of the system resolver. Names are looked up in Records, then queried from
+// the Servers of the first matching rule, or else the system resolver.
+// Answers are cached for their TTL, and served for up to MaxStale past it if
+// resolution then fails.
+type Resolver struct {
+	// Records are static addresses, keyed by exact hostname or glob.
+	Records map[string][]string `json:"records,omitempty"`
+
+	Rules []ResolverRule `json:"rules,omitempty"`
+
+	Timeout  int `json:"timeoutMs,omitempty"`   // Per server and query, default 2s
+	MaxStale int `json:"maxStaleSec,omitempty"` // Default 1 hour; negative to disable
+
+	once    sync.Once
+	records map[string][]netip.Addr
+	globs   []string // Glob keys of records, longest first
+	err     error
+
+	mu     sync.Mutex
+	cache  map[string]*dnsEntry
+	calls  map[string]*dnsCall // Lookups in progress
+	pruned time.Time
+}
+
+// ResolverRule sends queries for Domains, or all hosts if empty, to
+// Servers ("IP" or "IP:PORT"), in order until one answers.
+type ResolverRule struct {
+	Domains []string `json:"domains,omitempty"`
+	Servers []string `json:"servers"`
+}
+
+type dnsEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+const (
+	defaultDNSTimeout  = 2 * time.Second
+	defaultDNSMaxStale = time.Hour
+
+	// The system resolver does not report TTLs.
+	systemDNSTTL = 30 * time.Second
+
+	// Entries too stale to serve are dropped at most this often.
+	dnsPruneInterval = time.Minute
+
+	// As for net.Dialer.
+	defaultDialFallbackDelay = 300 * time.Millisecond
+
+	// While other addresses are left, each is tried for this long without
+	// a deadline, and for at least this long with one.
+	dialAttemptTimeout = 5 * time.Second
+)
+
+func ReadResolverFile(name string) (*Resolver, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var res Resolver
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", name, err)
+	}
+
+	if err := res.init(); err != nil {
+		return nil, fmt.Errorf("resolver %s: %w", name, err)
+	}
+
+	return &res, nil
+}
+
+func (res *Resolver) init() error {
+	res.once.Do(func() {
+		res.records = make(map[string][]netip.Addr)
+
+		for name, ss := range res.Records {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+			for _, s := range ss {
+				addr, err := netip.ParseAddr(s)
+				if err != nil {
+					res.err = fmt.Errorf("record %s: %w", name, err)
+					return
+				}
+				res.records[name] = append(res.records[name], addr)
+			}
+
+			if strings.ContainsAny(name, "*?[") {
+				if _, err := path.Match(name, ""); err != nil {
+					res.err = fmt.Errorf("bad hostname pattern %q: %w", name, err)
+					return
+				}
+				res.globs = append(res.globs, name)
+			}
+		}
+
+		slices.SortFunc(res.globs, func(a, b string) int { return len(b) - len(a) })
+	})
+	return res.err
+}
+
+func (res *Resolver) record(host string) ([]netip.Addr, bool) {
+	if addrs, ok := res.records[host]; ok {
+		return addrs, true
+	}
+
+	for _, pat := range res.globs {
+		if matchHostGlob(pat, host) {
+			return res.records[pat], true
+		}
+	}
+
+	return nil, false
+}
+
+func (pr *Proxy) Resolver() *Resolver { return pr.resolver.Load() }
+
+// SetResolver atomically replaces the resolver used for direct upstream
+// connections, or restores the system resolver if nil.
+func (pr *Proxy) SetResolver(res *Resolver) { pr.resolver.Store(res) }
+
+func (pr *Proxy) LoadResolverFile(name string) error {
+	res, err := ReadResolverFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetResolver(res)
+	return nil
+}
+
+// LookupNetIP returns the addresses of host. If resolution fails but an
+// expired answer is still within MaxStale, it is returned along with the
+// error. Concurrent lookups of the same host share one resolution.
+func (res *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	if err := res.init(); err != nil {
+		return nil, err
+	}
+
+	host = canonicalHostname(host)
+
+	if addrs, ok := res.record(host); ok {
+		return addrs, nil
+	}
+
+	now := time.Now()
+
+	res.mu.Lock()
+	entry := res.cache[host]
+	if entry != nil && now.Before(entry.expires) {
+		res.mu.Unlock()
+		return entry.addrs, nil
+	}
+
+	call, ok := res.calls[host]
+	if !ok {
+		if res.calls == nil {
+			res.calls = make(map[string]*dnsCall)
+		}
+		call = &dnsCall{done: make(chan struct{})}
+		res.calls[host] = call
+	}
+	res.mu.Unlock()
+
+	if ok {
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		// The lookup is shared, so it is not cut short by one caller.
+		call.addrs, call.ttl, call.err = res.resolve(context.WithoutCancel(ctx), host)
+		res.store(host, call, now)
+		close(call.done)
+	}
+
+	if call.err != nil {
+		if entry != nil && now.Before(entry.expires.Add(res.maxStale())) {
+			return entry.addrs, call.err
+		}
+		return nil, call.err
+	}
+
+	return call.addrs, nil
+}
+
+type dnsCall struct {
+	done  chan struct{}
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+}
+
+// store caches the outcome of call, and drops entries that are too stale
+// to be served.
+func (res *Resolver) store(host string, call *dnsCall, now time.Time) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	delete(res.calls, host)
+
+	if call.err == nil {
+		if res.cache == nil {
+			res.cache = make(map[string]*dnsEntry)
+		}
+		res.cache[host] = &dnsEntry{addrs: call.addrs, expires: now.Add(call.ttl)}
+	}
+
+	if now.Sub(res.pruned) < dnsPruneInterval {
+		return
+	}
+	res.pruned = now
+
+	maxStale := res.maxStale()
+	for host, entry := range res.cache {
+		if now.After(entry.expires.Add(maxStale)) {
+			delete(res.cache, host)
+		}
+	}
+}
+
+func (res *Resolver) maxStale() time.Duration {
+	switch {
+	case res.MaxStale < 0:
+		return 0
+	case res.MaxStale == 0:
+		return defaultDNSMaxStale
+	}
+	return time.Duration(res.MaxStale) * time.Second
+}
+
+func (res *Resolver) servers(host string) []string {
+	for _, rule := range res.Rules {
+		if len(rule.Domains) == 0 || matchHostGlobs(rule.Domains, host) {
+			return rule.Servers
+		}
+	}
+	return nil
+}
+
+// resolve queries for the A and AAAA records of host.
+func (res *Resolver) resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	servers := res.servers(host)
+	if len(servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		return addrs, systemDNSTTL, err
+	}
+
+	timeout := defaultDNSTimeout
+	if res.Timeout > 0 {
+		timeout = time.Duration(res.Timeout) * time.Millisecond
+	}
+
+	var (
+		addrs    []netip.Addr
+		ttl      time.Duration
+		answered bool
+		errs     []error
+	)
+
+	// The first server to answer each query is believed, even if it has
+	// no records; the next is only tried on errors and server failures.
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		for _, server := range servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+
+			qctx, cancel := context.WithTimeout(ctx, timeout)
+			answers, qttl, err := dnsQuery(qctx, server, host, qtype)
+			cancel()
+
+			var dnsErr *net.DNSError
+			if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+				errs = append(errs, fmt.Errorf("%s: %w", server, err))
+				continue
+			}
+
+			answered = true
+
+			if len(answers) > 0 {
+				if len(addrs) == 0 || qttl < ttl {
+					ttl = qttl
+				}
+				addrs = append(addrs, answers...)
+			}
+			break
+		}
+	}
+
+	switch {
+	case len(addrs) > 0:
+		return addrs, ttl, nil
+	case answered:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+// resolveDial dials addr, resolving its hostname with the configured
+// resolver, if any.
+func (pr *Proxy) resolveDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	res := pr.Resolver()
+	if res == nil {
+		return pr.Dialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := res.LookupNetIP(ctx, host)
+	if err != nil {
+		if len(addrs) == 0 {
+			pr.logger("proxy").Warn("resolve", "host", host, "err", err)
+			return nil, err
+		}
+		pr.logger("proxy").Warn("resolve, using stale answer", "host", host, "err", err)
+	}
+
+	addrs = slices.DeleteFunc(slices.Clone(addrs), func(ip netip.Addr) bool {
+		return network == "tcp4" && !ip.Is4() || network == "tcp6" && ip.Is4()
+	})
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+
+	return pr.dialAddrs(ctx, network, addrs, port)
+}
+
+// dialAddrs dials the first of addrs to answer on port, as net.Dialer
+// does: addresses of the family of the first are tried in turn, racing
+// those of the other family once FallbackDelay has passed.
+func (pr *Proxy) dialAddrs(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	if pr.Dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pr.Dialer.Timeout)
+		defer cancel()
+	}
+
+	var primaries, fallbacks []netip.Addr
+	for _, ip := range addrs {
+		if ip.Is4() == addrs[0].Is4() || pr.Dialer.FallbackDelay < 0 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	if len(fallbacks) == 0 {
+		return pr.dialSerial(ctx, network, primaries, port)
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	var (
+		results  = make(chan dialResult)
+		returned = make(chan struct{})
+	)
+	defer close(returned)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	race := func(addrs []netip.Addr, primary bool) {
+		conn, err := pr.dialSerial(ctx, network, addrs, port)
+		select {
+		case results <- dialResult{conn, err, primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(primaries, true)
+
+	delay := pr.Dialer.FallbackDelay
+	if delay == 0 {
+		delay = defaultDialFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go race(fallbacks, false)
+
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+				// Start the fallbacks now, rather than wait for the timer.
+				if fallbackTimer.Stop() {
+					go race(fallbacks, false)
+				}
+			} else {
+				fallbackErr = res.err
+			}
+
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, errors.Join(primaryErr, fallbackErr)
+			}
+		}
+	}
+}
+
+// dialSerial tries each of addrs in turn. Each attempt but the last is
+// given a share of the time left, as with net.Dialer, or dialAttemptTimeout
+// if there is no deadline, so that an unreachable address does not hold up
+// the others until the system gives up on it.
+func (pr *Proxy) dialSerial(ctx context.Context, network string, addrs []netip.Addr, port string) (net.Conn, error) {
+	var errs []error
+	for i, ip := range addrs {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if remaining := len(addrs) - i; remaining > 1 {
+			timeout := dialAttemptTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = max(time.Until(deadline)/time.Duration(remaining), min(time.Until(deadline), dialAttemptTimeout))
+			}
+			actx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		conn, err := pr.Dialer.DialContext(actx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dnsQuery asks server for the records of qtype for name over UDP, and
+// again over TCP if the answer was truncated. It returns the addresses
+// answered, and the lowest TTL among them.
+func dnsQuery(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	msg, id, err := dnsQueryMessage(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Ignore stray responses to earlier queries.
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || !h.Response || h.ID != id {
+			continue
+		}
+
+		if h.Truncated {
+			return dnsQueryTCP(ctx, &d, server, name, msg, id, qtype)
+		}
+		return dnsAnswers(&p, h, name, qtype)
+	}
+}
+
+func dnsQueryTCP(ctx context.Context, d *net.Dialer, server, name string, msg []byte, id uint16, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return nil, 0, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, 0, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("dns %s: %w", server, err)
+	} else if !h.Response || h.ID != id {
+		return nil, 0, fmt.Errorf("dns %s: mismatched response", server)
+	}
+
+	return dnsAnswers(&p, h, name, qtype)
+}
+
+func dnsQueryMessage(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid hostname", Name: name}
+	}
+
+	var b [2]byte
+	rand.Read(b[:])
+	id := binary.BigEndian.Uint16(b[:])
+
+	msg, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid hostname", Name: name}
+	}
+
+	return msg, id, nil
+}
+
+// dnsAnswers returns the addresses of qtype answered in the response whose
+// header has been parsed by p.
+func dnsAnswers(p *dnsmessage.Parser, h dnsmessage.Header, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: fmt.Sprintf("server failure (%s)", h.RCode), Name: name, IsTemporary: true}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   uint32
+	)
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		var addr netip.Addr
+
+		// Answers for aliases follow their CNAME records.
+		switch {
+		case rh.Class != dnsmessage.ClassINET || rh.Type != qtype:
+			err = p.SkipAnswer()
+		case qtype == dnsmessage.TypeA:
+			var r dnsmessage.AResource
+			r, err = p.AResource()
+			addr = netip.AddrFrom4(r.A)
+		case qtype == dnsmessage.TypeAAAA:
+			var r dnsmessage.AAAAResource
+			r, err = p.AAAAResource()
+			addr = netip.AddrFrom16(r.AAAA).Unmap()
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if !addr.IsValid() {
+			continue
+		}
+
+		if len(addrs) == 0 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,244 @@
+package chromekiosk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestDNSServer starts a stand-in DNS server answering A queries from
+// records with the given TTL, or SERVFAIL while failing is set.
+func newTestDNSServer(t *testing.T, records map[string]string, ttl uint32) (string, *atomic.Int32, *atomic.Bool) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var (
+		queries atomic.Int32
+		failing atomic.Bool
+	)
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: h.ID, Response: true, RecursionDesired: true, RecursionAvailable: true},
+				Questions: []dnsmessage.Question{q},
+			}
+
+			ip, ok := records[strings.TrimSuffix(q.Name.String(), ".")]
+			switch {
+			case failing.Load():
+				resp.RCode = dnsmessage.RCodeServerFailure
+			case !ok:
+				resp.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeA:
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+					Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+				}}
+			}
+
+			msg, _ := resp.Pack()
+			pc.WriteTo(msg, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String(), &queries, &failing
+}
+
+func TestResolver(t *testing.T) {
+	ctx := context.Background()
+
+	server, queries, failing := newTestDNSServer(t, map[string]string{
+		"dashboard.site.test": "127.0.0.1",
+		"panel.site.test":     "127.0.0.2",
+	}, 300)
+
+	res := Resolver{
+		Records: map[string][]string{
+			"static.test":   {"192.0.2.1", "2001:db8::1"},
+			"*.static.test": {"192.0.2.2"},
+		},
+		Rules: []ResolverRule{{Domains: []string{"*.site.test"}, Servers: []string{server}}},
+	}
+
+	for host, want := range map[string]string{
+		"static.test":         "[192.0.2.1 2001:db8::1]",
+		"a.STATIC.test":       "[192.0.2.2]",
+		"dashboard.site.test": "[127.0.0.1]",
+		"10.1.2.3":            "[10.1.2.3]",
+	} {
+		addrs, err := res.LookupNetIP(ctx, host)
+		if err != nil {
+			t.Errorf("%s: %s", host, err)
+		} else if got := fmt.Sprint(addrs); got != want {
+			t.Errorf("%s: got %s, want %s", host, got, want)
+		}
+	}
+
+	// A and AAAA were each queried once, and then cached.
+	res.LookupNetIP(ctx, "dashboard.site.test")
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries, want 2", n)
+	}
+
+	if _, err := res.LookupNetIP(ctx, "missing.site.test"); err == nil {
+		t.Errorf("missing.site.test: expected error")
+	}
+
+	// Concurrent misses share the same queries.
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := res.LookupNetIP(ctx, "panel.site.test"); err != nil {
+				t.Errorf("panel.site.test: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := queries.Load(); n != 6 {
+		t.Errorf("%d queries, want 6", n)
+	}
+
+	// Expired answers are served when the server fails.
+	res.mu.Lock()
+	for _, entry := range res.cache {
+		entry.expires = entry.expires.Add(-300 * time.Second)
+	}
+	res.mu.Unlock()
+
+	failing.Store(true)
+
+	addrs, err := res.LookupNetIP(ctx, "dashboard.site.test")
+	if err == nil || len(addrs) != 1 {
+		t.Errorf("stale: got %v %v", addrs, err)
+	}
+
+	res.MaxStale = -1
+
+	if addrs, err := res.LookupNetIP(ctx, "dashboard.site.test"); err == nil || len(addrs) != 0 {
+		t.Errorf("MaxStale -1: got %v %v", addrs, err)
+	}
+
+	// Entries too stale to serve are dropped.
+	res.mu.Lock()
+	res.pruned = time.Time{}
+	res.mu.Unlock()
+
+	res.LookupNetIP(ctx, "missing.site.test")
+
+	res.mu.Lock()
+	if _, ok := res.cache["dashboard.site.test"]; ok || len(res.cache) != 0 {
+		t.Errorf("not pruned: %v", res.cache)
+	}
+	res.mu.Unlock()
+}
+
+func TestProxyResolver(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	}))
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	var pr Proxy
+	pr.SetResolver(&Resolver{
+		Records: map[string][]string{"dashboard.test": {"127.0.0.1"}},
+	})
+
+	r := httptest.NewRequest("GET", "http://dashboard.test:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, r)
+
+	if want := "hello dashboard.test:" + port; w.Body.String() != want {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestProxyResolverDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var pr Proxy
+	pr.SetResolver(&Resolver{
+		Records: map[string][]string{
+			"dashboard.test": {"2001:db8::1", "127.0.0.1"},
+			"v4.test":        {"127.0.0.1"},
+		},
+	})
+
+	// The unreachable IPv6 address is raced by the IPv4 one.
+	pr.Dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if strings.HasPrefix(address, "[2001:db8::1]") {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := pr.resolveDial(ctx, "tcp", "dashboard.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("dialed %s", got)
+	}
+	conn.Close()
+
+	if _, err := pr.resolveDial(ctx, "tcp6", "v4.test:"+port); err == nil {
+		t.Errorf("tcp6: dialed an IPv4 address")
+	}
+}
@@ -0,0 +1,326 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// SOCKS5, RFC 1928, with username/password authentication, RFC 1929, as
+// used both to reach an upstream proxy and by ServeSOCKS.
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksAuthNoAccept = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded          = 0
+	socksRepGeneralFailure     = 1
+	socksRepNotAllowed         = 2
+	socksRepHostUnreachable    = 4
+	socksRepCmdNotSupported    = 7
+	socksRepAtypNotSupported   = 8
+	socksPasswordVersion       = 1
+	socksPasswordStatusSuccess = 0
+)
+
+// socksConnect asks the SOCKS5 server on conn to connect to addr.
+func socksConnect(conn net.Conn, addr, user, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: bad port %q", portStr)
+	}
+
+	methods := []byte{socksAuthNone}
+	if user != "" {
+		methods = []byte{socksAuthPassword}
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+
+	case socksAuthPassword:
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+
+		req := []byte{socksPasswordVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+
+		if reply[1] != socksPasswordStatusSuccess {
+			return errors.New("socks5: authentication failed")
+		}
+
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	req = appendSocksAddr(req, host)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+
+	if hdr[1] != socksRepSucceeded {
+		return fmt.Errorf("socks5: connect %s: reply %d", addr, hdr[1])
+	}
+
+	if _, _, err := readSocksAddr(conn, hdr[3]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func appendSocksAddr(b []byte, host string) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return append(append(b, socksAtypIPv4), ip4...)
+		}
+		return append(append(b, socksAtypIPv6), ip.To16()...)
+	}
+
+	b = append(b, socksAtypDomain, byte(len(host)))
+	return append(b, host...)
+}
+
+// readSocksAddr reads an address of type atyp and a port.
+func readSocksAddr(r io.Reader, atyp byte) (host string, port string, err error) {
+	var buf []byte
+
+	switch atyp {
+	case socksAtypIPv4:
+		buf = make([]byte, net.IPv4len)
+
+	case socksAtypIPv6:
+		buf = make([]byte, net.IPv6len)
+
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", "", err
+		}
+		buf = make([]byte, n[0])
+
+	default:
+		return "", "", fmt.Errorf("socks5: unknown address type %d", atyp)
+	}
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", "", err
+	}
+
+	var portBuf [2]byte
+	if _, err := io.ReadFull(r, portBuf[:]); err != nil {
+		return "", "", err
+	}
+
+	if atyp == socksAtypDomain {
+		host = string(buf)
+	} else {
+		host = net.IP(buf).String()
+	}
+
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(portBuf[:]))), nil
+}
+
+// ServeSOCKS accepts SOCKS5 clients on ln until ctx is done. Only the
+// CONNECT command without authentication is supported; each connection is
+// subject to the same internal Chrome filtering, policy and HostMap
+// translation as a CONNECT request to the HTTP proxy.
+func (pr *Proxy) ServeSOCKS(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go pr.serveSOCKS(ctx, conn)
+	}
+}
+
+func (pr *Proxy) serveSOCKS(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	bufr := bufio.NewReader(conn)
+
+	addr, err := socksHandshake(conn, bufr)
+	if err != nil {
+		pr.logger("socks").Warn("handshake", "client", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	r := (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(ctx)
+
+	if pr.blockInternal(r) {
+		socksReply(conn, socksRepNotAllowed, nil)
+		return
+	}
+
+	if action, _ := pr.Policy().Decide(r); action != PolicyAllow {
+		pr.logger("socks").Info("policy deny", "method", http.MethodConnect, "host", addr)
+		socksReply(conn, socksRepNotAllowed, nil)
+		return
+	}
+
+	pr.logger("socks").Debug("request", "method", http.MethodConnect, "host", addr)
+
+	host, _, _ := net.SplitHostPort(addr)
+
+	if pr.interceptHost(host) {
+		socksReply(conn, socksRepSucceeded, conn.LocalAddr())
+
+		metricProxyTunnels.Inc()
+		defer metricProxyTunnels.Dec()
+
+		pr.intercept(ctx, conn, bufr, addr)
+		return
+	}
+
+	upconn, err := pr.dialTarget(ctx, addr)
+	if err != nil {
+		pr.logger("socks").Warn("dial", "method", http.MethodConnect, "host", addr, "err", err)
+		metricProxyRequests.Inc(hostLabel(host), "error")
+		socksReply(conn, socksRepHostUnreachable, nil)
+		return
+	}
+
+	defer upconn.Close()
+
+	metricProxyRequests.Inc(hostLabel(host), "200")
+	metricProxyTunnels.Inc()
+	defer metricProxyTunnels.Dec()
+
+	if err := socksReply(conn, socksRepSucceeded, upconn.LocalAddr()); err != nil {
+		return
+	}
+
+	teeConn(&bufConn{Conn: conn, r: bufr}, meteredConn{upconn})
+}
+
+// socksHandshake negotiates no authentication and reads a CONNECT request,
+// returning its target as host:port. Failures are replied to the client.
+func socksHandshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return "", err
+	}
+
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("socks5: unexpected version %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+
+	if !slices.Contains(methods, socksAuthNone) {
+		conn.Write([]byte{socksVersion, socksAuthNoAccept})
+		return "", errors.New("socks5: no acceptable authentication method")
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, socksAuthNone}); err != nil {
+		return "", err
+	}
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+
+	host, port, err := readSocksAddr(r, hdr[3])
+	if err != nil {
+		socksReply(conn, socksRepAtypNotSupported, nil)
+		return "", err
+	}
+
+	if hdr[1] != socksCmdConnect {
+		socksReply(conn, socksRepCmdNotSupported, nil)
+		return "", fmt.Errorf("socks5: unsupported command %d", hdr[1])
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func socksReply(conn net.Conn, rep byte, bound net.Addr) error {
+	var (
+		ip   = net.IPv4zero
+		port int
+	)
+
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+
+	b := []byte{socksVersion, rep, 0}
+	b = appendSocksAddr(b, ip.String())
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+
+	_, err := conn.Write(b)
+	return err
+}
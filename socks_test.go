@@ -0,0 +1,80 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeSOCKS(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	var pr = Proxy{
+		HostMap: map[string]string{"origin.test": "127.0.0.1"},
+	}
+
+	pr.SetPolicy(&Policy{
+		Rules: []PolicyRule{
+			{Action: PolicyAllow, Hosts: []string{"origin.test"}},
+		},
+		Default: PolicyDeny,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go pr.ServeSOCKS(ctx, ln)
+
+	var testcases = []struct {
+		addr string
+		ok   bool
+	}{
+		{net.JoinHostPort("origin.test", port), true},
+		{origin.Listener.Addr().String(), false},
+	}
+
+	for _, tc := range testcases {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = socksConnect(conn, tc.addr, "", "")
+		if ok := err == nil; ok != tc.ok {
+			t.Errorf("%s: got %v, expect ok=%v", tc.addr, err, tc.ok)
+		}
+
+		if err == nil {
+			req, _ := http.NewRequest("GET", "http://origin.test/", nil)
+			req.Write(conn)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(body) != "hello" {
+				t.Errorf("%s: got %q", tc.addr, body)
+			}
+		}
+
+		conn.Close()
+	}
+}
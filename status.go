@@ -0,0 +1,102 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The Monitor serves MonitorStatus to the kiosk at statusPath on statusHost,
+// unless the proxy already has a handler for the host. Other requests for
+// the host are forwarded as usual. HTTPS for the host is only served when
+// the proxy intercepts everything; otherwise it is tunnelled untouched.
+const (
+	statusHost = "kiosk.localhost"
+	statusPath = "/.chromekiosk/status"
+)
+
+type MonitorStatus struct {
+	Hostname     string    `json:"hostname"`
+	StartUrl     string    `json:"startUrl"`
+	ImageVersion string    `json:"imageVersion,omitempty"`
+	StartTime    time.Time `json:"startTime"`
+	Uptime       float64   `json:"uptime"`      // Seconds since the device booted
+	KioskUptime  float64   `json:"kioskUptime"` // Seconds since the Monitor started
+}
+
+func (m *Monitor) Status() MonitorStatus {
+	st := MonitorStatus{
+		StartUrl:     m.Browser.StartUrl,
+		ImageVersion: m.ImageVersion,
+		StartTime:    m.startTime,
+	}
+
+	st.Hostname, _ = os.Hostname()
+
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err == nil {
+		st.Uptime = float64(info.Uptime)
+	}
+
+	if !m.startTime.IsZero() {
+		st.KioskUptime = time.Since(m.startTime).Seconds()
+	}
+
+	return st
+}
+
+// statusHandler serves the status on statusHost, forwarding everything else
+// through pr.
+func (m *Monitor) statusHandler(pr *Proxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == statusPath {
+			m.serveStatus(w, r)
+		} else {
+			pr.passthru(w, r)
+		}
+	})
+}
+
+func (m *Monitor) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(m.Status())
+}
+
+// readImageVersion returns the first of IMAGE_VERSION, BUILD_ID,
+// VERSION_ID or PRETTY_NAME found in an os-release file.
+func readImageVersion(name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var (
+		vars = make(map[string]string)
+		sc   = bufio.NewScanner(f)
+	)
+
+	for sc.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if ok && !strings.HasPrefix(k, "#") {
+			vars[k] = strings.Trim(v, `"'`)
+		}
+	}
+
+	for _, k := range []string{"IMAGE_VERSION", "BUILD_ID", "VERSION_ID", "PRETTY_NAME"} {
+		if v := vars[k]; v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,91 @@
+package chromekiosk
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMonitorStatus(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "app "+r.URL.Path)
+	}))
+	defer app.Close()
+
+	name := filepath.Join(t.TempDir(), "os-release")
+	os.WriteFile(name, []byte("NAME=\"Debian\"\nVERSION_ID=\"12\"\nIMAGE_VERSION=2024.06.1\n"), 0o644)
+
+	var m Monitor
+	m.Browser.StartUrl = "https://example.com/"
+	m.ImageVersion = readImageVersion(name)
+
+	pr := Proxy{HostMap: map[string]string{statusHost: app.Listener.Addr().String()}}
+	pr.handlePlain(statusHost, m.statusHandler(&pr))
+
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, httptest.NewRequest("GET", "http://kiosk.localhost"+statusPath, nil))
+
+	var st MonitorStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+
+	if st.StartUrl != m.Browser.StartUrl || st.ImageVersion != "2024.06.1" || st.Hostname == "" {
+		t.Errorf("got %+v", st)
+	}
+
+	// Apps served on the host through HostMap are still reachable.
+	w = httptest.NewRecorder()
+	pr.ServeHTTP(w, httptest.NewRequest("GET", "http://kiosk.localhost/index.html", nil))
+
+	if got := w.Body.String(); got != "app /index.html" {
+		t.Errorf("forwarded: got %d %q", w.Code, got)
+	}
+}
+
+func TestMonitorStatusTunnel(t *testing.T) {
+	app := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "app "+r.URL.Path)
+	}))
+	defer app.Close()
+
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m Monitor
+
+	pr := Proxy{CA: ca, HostMap: map[string]string{statusHost: app.Listener.Addr().String()}}
+	pr.handlePlain(statusHost, m.statusHandler(&pr))
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	tr := app.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(must(url.Parse(proxy.URL)))
+	tr.TLSClientConfig.ServerName = "example.com"
+	client := http.Client{Transport: tr}
+
+	// Without Intercept, HTTPS for the status host reaches the mapped app
+	// through an untouched tunnel.
+	resp, err := client.Get("https://kiosk.localhost/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if got := string(body); got != "app /index.html" {
+		t.Errorf("got %q", got)
+	}
+
+	if !resp.TLS.PeerCertificates[0].Equal(app.Certificate()) {
+		t.Errorf("tunnel intercepted")
+	}
+}
@@ -0,0 +1,292 @@
+package chromekiosk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ThrottleRule shapes upstream traffic for hosts matching Hosts, or all
+// hosts if empty, to simulate a slow network. Rate is shared by all
+// requests and tunnels matching the rule, in each direction.
+type ThrottleRule struct {
+	Hosts []string `json:"hosts,omitempty"`
+
+	Rate     int64 `json:"rate,omitempty"`      // Bytes per second, 0 for unlimited
+	Latency  int   `json:"latencyMs,omitempty"` // Added before each request and tunnel
+	Jitter   int   `json:"jitterMs,omitempty"`  // Random extra latency, up to this much
+	StallMs  int   `json:"stallMs,omitempty"`   // Length of simulated stalls
+	StallPct int   `json:"stallPct,omitempty"`  // Chance of stalling before each read, in percent
+}
+
+type Throttle struct {
+	Rules []ThrottleRule `json:"rules"`
+
+	once   sync.Once
+	active []*activeThrottle
+}
+
+// activeThrottle is a rule along with the shared rate limits for each
+// direction.
+type activeThrottle struct {
+	*ThrottleRule
+	up, down throttleShaper
+}
+
+func ReadThrottleFile(name string) (*Throttle, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var t Throttle
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("throttle %s: %w", name, err)
+	}
+
+	return &t, nil
+}
+
+func (t *Throttle) rule(host string) *activeThrottle {
+	if t == nil {
+		return nil
+	}
+
+	t.once.Do(func() {
+		for i := range t.Rules {
+			rule := &t.Rules[i]
+			t.active = append(t.active, &activeThrottle{
+				ThrottleRule: rule,
+				up:           throttleShaper{rate: rule.Rate},
+				down:         throttleShaper{rate: rule.Rate},
+			})
+		}
+	})
+
+	host = canonicalHostname(host)
+
+	for _, at := range t.active {
+		if len(at.Hosts) == 0 || matchHostGlobs(at.Hosts, host) {
+			return at
+		}
+	}
+
+	return nil
+}
+
+func (pr *Proxy) Throttle() *Throttle { return pr.throttle.Load() }
+
+// SetThrottle atomically replaces the throttle rules, which only apply
+// while throttling is enabled with SetThrottling.
+func (pr *Proxy) SetThrottle(t *Throttle) { pr.throttle.Store(t) }
+
+func (pr *Proxy) LoadThrottleFile(name string) error {
+	t, err := ReadThrottleFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetThrottle(t)
+	return nil
+}
+
+func (pr *Proxy) Throttling() bool { return pr.throttling.Load() }
+
+func (pr *Proxy) SetThrottling(on bool) { pr.throttling.Store(on) }
+
+func (pr *Proxy) throttleFor(host string) *activeThrottle {
+	if !pr.Throttling() {
+		return nil
+	}
+	return pr.Throttle().rule(host)
+}
+
+// delay waits for the rule's latency and jitter.
+func (at *activeThrottle) delay(ctx context.Context) error {
+	d := time.Duration(at.Latency) * time.Millisecond
+	if at.Jitter > 0 {
+		d += rand.N(time.Duration(at.Jitter) * time.Millisecond)
+	}
+	return sleepCtx(ctx, d)
+}
+
+func (at *activeThrottle) stall(ctx context.Context) error {
+	if at.StallPct > 0 && rand.IntN(100) < at.StallPct {
+		return sleepCtx(ctx, time.Duration(at.StallMs)*time.Millisecond)
+	}
+	return nil
+}
+
+// roundTrip delays req and shapes both bodies.
+func (at *activeThrottle) roundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if err := at.delay(req.Context()); err != nil {
+		return nil, err
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = readCloser{&throttledReader{ctx: req.Context(), r: req.Body, at: at, s: &at.up}, req.Body}
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &throttledStream{ReadWriteCloser: rwc, ctx: req.Context(), at: at}
+	} else {
+		resp.Body = readCloser{&throttledReader{ctx: req.Context(), r: resp.Body, at: at, s: &at.down}, resp.Body}
+	}
+	return resp, nil
+}
+
+// throttleConn delays and then shapes an upstream tunnel connection to
+// host. The tunnel follows throttling being turned on and off while it is
+// open.
+func (pr *Proxy) throttleConn(ctx context.Context, host string, conn net.Conn) (net.Conn, error) {
+	if pr.Throttle() == nil {
+		return conn, nil
+	}
+
+	if at := pr.throttleFor(host); at != nil {
+		if err := at.delay(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c := &throttledConn{Conn: conn, pr: pr, host: host}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	return c, nil
+}
+
+type throttleShaper struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// reserve accounts for n bytes and returns how long to wait before they
+// have been sent at rate.
+func (s *throttleShaper) reserve(n int) time.Duration {
+	if s.rate <= 0 || n <= 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	s.next = s.next.Add(time.Duration(n) * time.Second / time.Duration(s.rate))
+
+	return s.next.Sub(now)
+}
+
+// chunk limits single reads and writes to about a tenth of a second of
+// traffic, so that shaping is smooth.
+func (s *throttleShaper) chunk(n int) int {
+	if s.rate <= 0 {
+		return n
+	}
+	return min(n, max(int(s.rate/10), 512))
+}
+
+// throttledReader shapes r, giving up waiting once ctx is done.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	at  *activeThrottle
+	s   *throttleShaper
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if err := tr.at.stall(tr.ctx); err != nil {
+		return 0, err
+	}
+
+	n, err := tr.r.Read(p[:tr.s.chunk(len(p))])
+	if serr := sleepCtx(tr.ctx, tr.s.reserve(n)); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// throttledStream shapes an upstream connection, or the body of an
+// upgraded response.
+type throttledStream struct {
+	io.ReadWriteCloser
+	ctx context.Context
+	at  *activeThrottle
+}
+
+func (ts *throttledStream) Read(p []byte) (int, error) {
+	return (&throttledReader{ctx: ts.ctx, r: ts.ReadWriteCloser, at: ts.at, s: &ts.at.down}).Read(p)
+}
+
+func (ts *throttledStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 && err == nil {
+		var m int
+		m, err = ts.ReadWriteCloser.Write(p[:ts.at.up.chunk(len(p))])
+		if serr := sleepCtx(ts.ctx, ts.at.up.reserve(m)); err == nil {
+			err = serr
+		}
+
+		n += m
+		p = p[m:]
+	}
+	return n, err
+}
+
+// throttledConn is a tunnel to host, shaped by whichever rule applies at
+// each read and write. Its context is done once it is closed.
+type throttledConn struct {
+	net.Conn
+	pr     *Proxy
+	host   string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (c *throttledConn) stream() io.ReadWriter {
+	if at := c.pr.throttleFor(c.host); at != nil {
+		return &throttledStream{ReadWriteCloser: c.Conn, ctx: c.ctx, at: at}
+	}
+	return c.Conn
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) { return c.stream().Read(p) }
+
+func (c *throttledConn) Write(p []byte) (int, error) { return c.stream().Write(p) }
+
+func (c *throttledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
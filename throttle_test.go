@@ -0,0 +1,95 @@
+package chromekiosk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyThrottle(t *testing.T) {
+	body := strings.Repeat("x", 10000)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	var pr Proxy
+	pr.SetThrottle(&Throttle{
+		Rules: []ThrottleRule{
+			{Hosts: []string{"example.com"}, Latency: 1000},
+			{Rate: 50000, Latency: 50},
+		},
+	})
+
+	get := func() time.Duration {
+		start := time.Now()
+
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, httptest.NewRequest("GET", upstream.URL+"/", nil))
+
+		if w.Body.String() != body {
+			t.Fatalf("got %d, %d bytes", w.Code, w.Body.Len())
+		}
+		return time.Since(start)
+	}
+
+	if d := get(); d > 150*time.Millisecond {
+		t.Errorf("throttled while disabled: %s", d)
+	}
+
+	pr.SetThrottling(true)
+
+	// 50ms latency, then 10 kB at 50 kB/s
+	if d := get(); d < 230*time.Millisecond {
+		t.Errorf("not throttled: %s", d)
+	}
+
+	start := time.Now()
+	conn, err := pr.dialTarget(context.Background(), upstream.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, ok := conn.(*throttledConn); !ok || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("tunnel not throttled: %T after %s", conn, time.Since(start))
+	}
+
+	if at := pr.throttleFor("Example.com"); at == nil || at.Latency != 1000 {
+		t.Errorf("first matching rule not used: %+v", at)
+	}
+	// Stalls end when the tunnel is closed, or once throttling is off.
+	pr.SetThrottle(&Throttle{Rules: []ThrottleRule{{StallMs: 10000, StallPct: 100}}})
+
+	conn, err = pr.dialTarget(context.Background(), upstream.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+
+	start = time.Now()
+	conn.Read(make([]byte, 1))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("stalled after close: %s", d)
+	}
+
+	conn, err = pr.dialTarget(context.Background(), upstream.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pr.SetThrottling(false)
+
+	start = time.Now()
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	if n, _ := io.ReadFull(conn, make([]byte, 12)); n != 12 || time.Since(start) > time.Second {
+		t.Errorf("still throttled: %d bytes after %s", n, time.Since(start))
+	}
+}
@@ -0,0 +1,346 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var noDeadline time.Time
+
+// UpstreamProxy is a proxy that all upstream traffic is sent through,
+// except for hosts matching NoProxy. URL is of the form
+// http://[user:password@]host:port, https://..., socks5://..., which is sent
+// addresses resolved by the proxy, or socks5h://..., which is sent hostnames.
+//
+// NoProxy follows the NO_PROXY convention: "*" bypasses everything, an IP
+// address or CIDR matches addresses, "example.com" matches that domain and
+// its subdomains, ".example.com" only its subdomains, and any entry may
+// carry a ":port" suffix.
+type UpstreamProxy struct {
+	URL     *url.URL
+	NoProxy []string
+}
+
+func ParseUpstreamProxy(rawURL, noProxy string) (*UpstreamProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+
+	default:
+		return nil, fmt.Errorf("upstream proxy %s: unsupported scheme %q", rawURL, u.Scheme)
+	}
+
+	if u.Port() == "" {
+		port := "1080"
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	up := UpstreamProxy{URL: u}
+
+	for _, s := range strings.Split(noProxy, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			up.NoProxy = append(up.NoProxy, strings.ToLower(s))
+		}
+	}
+
+	return &up, nil
+}
+
+func (up *UpstreamProxy) isSocks() bool {
+	return strings.HasPrefix(up.URL.Scheme, "socks5")
+}
+
+// bypass reports whether addr should be dialled directly. The upstream
+// proxy itself is always dialled directly.
+func (up *UpstreamProxy) bypass(addr string) bool {
+	if addr == up.URL.Host {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	for _, entry := range up.NoProxy {
+		if entry == "*" {
+			return true
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		name := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			name = h
+		}
+		name = strings.Trim(name, "[]")
+
+		if sub, ok := strings.CutPrefix(name, "."); ok {
+			if strings.HasSuffix(host, "."+sub) {
+				return true
+			}
+			continue
+		}
+
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dial connects to addr through the upstream proxy, using d to reach the
+// proxy itself.
+func (up *UpstreamProxy) dial(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", up.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(noDeadline)
+	}
+
+	var (
+		user     = up.URL.User.Username()
+		password string
+	)
+
+	if up.URL.User != nil {
+		password, _ = up.URL.User.Password()
+	}
+
+	if up.isSocks() {
+		if err := socksConnect(conn, addr, user, password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("upstream proxy %s: %w", up.URL.Redacted(), err)
+		}
+		return conn, nil
+	}
+
+	if up.URL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: up.URL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if auth := up.basicAuth(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	bufr := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(bufr, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A successful CONNECT response has no body; the tunnel follows.
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: CONNECT %s: %s", up.URL.Redacted(), addr, resp.Status)
+	}
+
+	if bufr.Buffered() > 0 {
+		return &bufConn{Conn: conn, r: bufr}, nil
+	}
+
+	return conn, nil
+}
+
+func (up *UpstreamProxy) basicAuth() string {
+	if up.URL.User == nil {
+		return ""
+	}
+
+	password, _ := up.URL.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(up.URL.User.Username()+":"+password))
+}
+
+// proxyURL is the http.Transport Proxy function for the default transport.
+// Only plain HTTP requests are sent to an HTTP upstream proxy as such;
+// everything else is tunnelled by dial, so that TLS connections to the
+// target are made by dialTLS, with the upstream TLS policy and client
+// certificates, rather than by the transport after its own CONNECT.
+func (pr *Proxy) proxyURL(req *http.Request) (*url.URL, error) {
+	if _, ok := req.Context().Value(unixSocketKey{}).(string); ok {
+		return nil, nil
+	}
+
+	if req.URL.Scheme != "http" {
+		return nil, nil
+	}
+
+	up := pr.Upstream
+	if up == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	if up.isSocks() || up.bypass(canonicalAddr(req.URL)) {
+		return nil, nil
+	}
+
+	return up.URL, nil
+}
+
+// envUpstream returns the upstream proxy that the environment gives for a
+// request to addr with scheme, if any.
+func envUpstream(scheme, addr string) (*UpstreamProxy, error) {
+	u, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil || u == nil {
+		return nil, err
+	}
+
+	return ParseUpstreamProxy(u.String(), "")
+}
+
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(u.Scheme)
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dial opens upstream connections for both forwarded requests and CONNECT
+// tunnels, going through the upstream proxy if one is configured, or else
+// given by the environment for HTTPS, or to the unix domain socket or
+// address a request was mapped to.
+func (pr *Proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return pr.dialScheme(ctx, "https", network, addr)
+}
+
+// dialHTTP opens connections for plain HTTP requests, which proxyURL has
+// already sent to HTTP_PROXY if the environment gives one; addr is then
+// that proxy, which is dialled directly.
+func (pr *Proxy) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	return pr.dialScheme(ctx, "http", network, addr)
+}
+
+func (pr *Proxy) dialScheme(ctx context.Context, scheme, network, addr string) (net.Conn, error) {
+	if path, ok := ctx.Value(unixSocketKey{}).(string); ok {
+		return pr.Dialer.DialContext(ctx, "unix", path)
+	}
+
+	if target, ok := ctx.Value(hostTargetKey{}).(HostTarget); ok {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = target.addr(port)
+	}
+
+	up := pr.Upstream
+	if up == nil {
+		var err error
+		if up, err = envUpstream(scheme, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if up == nil || up.bypass(addr) {
+		return pr.resolveDial(ctx, network, addr)
+	}
+
+	// Only socks5h is sent the hostname to resolve.
+	if up.URL.Scheme == "socks5" {
+		var err error
+		if addr, err = pr.resolveAddr(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	return up.dial(ctx, &pr.Dialer, addr)
+}
+
+// resolveAddr replaces the host of addr with its first address.
+func (pr *Proxy) resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+
+	var addrs []netip.Addr
+	if res := pr.Resolver(); res != nil {
+		addrs, err = res.LookupNetIP(ctx, host)
+	} else {
+		addrs, err = cmp.Or(pr.Dialer.Resolver, net.DefaultResolver).LookupNetIP(ctx, "ip", host)
+	}
+
+	if len(addrs) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return "", err
+	}
+
+	return net.JoinHostPort(addrs[0].Unmap().String(), port), nil
+}
+
+func (pr *Proxy) transport() http.RoundTripper {
+	if tr := pr.Transport; tr != nil {
+		return tr
+	}
+
+	pr.transportOnce.Do(func() {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = pr.proxyURL
+		tr.DialContext = pr.dialHTTP
+		tr.DialTLSContext = pr.dialTLS
+		pr.defaultTransport = tr
+	})
+
+	return pr.defaultTransport
+}
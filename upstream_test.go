@@ -0,0 +1,223 @@
+package chromekiosk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestHTTPProxy starts a stand-in corporate proxy requiring Basic auth,
+// which handles both CONNECT and absolute-URI requests.
+func newTestHTTPProxy(t *testing.T, auth string) (*httptest.Server, *atomic.Int32) {
+	var n atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		n.Add(1)
+
+		if r.Method == http.MethodConnect {
+			upconn, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			teeConn(conn, upconn)
+			return
+		}
+
+		r.RequestURI = ""
+		resp, err := (&http.Transport{}).RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &n
+}
+
+// newTestSocksProxy starts a stand-in SOCKS5 server requiring the given
+// username and password, which keeps the last host it was asked for.
+func newTestSocksProxy(t *testing.T, user, password string) (net.Listener, *atomic.Int32, *atomic.Value) {
+	var (
+		n        atomic.Int32
+		lastHost atomic.Value
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		buf := make([]byte, 256)
+
+		io.ReadFull(r, buf[:2])
+		io.ReadFull(r, buf[:buf[1]])
+		conn.Write([]byte{socksVersion, socksAuthPassword})
+
+		io.ReadFull(r, buf[:2])
+		u := make([]byte, buf[1])
+		io.ReadFull(r, u)
+		io.ReadFull(r, buf[:1])
+		p := make([]byte, buf[0])
+		io.ReadFull(r, p)
+
+		if string(u) != user || string(p) != password {
+			conn.Write([]byte{socksPasswordVersion, 1})
+			return
+		}
+		conn.Write([]byte{socksPasswordVersion, socksPasswordStatusSuccess})
+
+		io.ReadFull(r, buf[:4])
+		host, port, err := readSocksAddr(r, buf[3])
+		if err != nil {
+			return
+		}
+		lastHost.Store(host)
+
+		upconn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			conn.Write([]byte{socksVersion, socksRepHostUnreachable, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+
+		n.Add(1)
+
+		reply := []byte{socksVersion, socksRepSucceeded, 0, socksAtypIPv4, 0, 0, 0, 0}
+		conn.Write(binary.BigEndian.AppendUint16(reply, 0))
+
+		teeConn(&bufConn{Conn: conn, r: r}, upconn)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	return ln, &n, &lastHost
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "origin "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	tlsOrigin := httptest.NewTLSServer(origin.Config.Handler)
+	defer tlsOrigin.Close()
+
+	httpProxy, httpProxyHits := newTestHTTPProxy(t, "Basic a2lvc2s6c2VjcmV0")
+	socksProxy, socksProxyHits, _ := newTestSocksProxy(t, "kiosk", "secret")
+
+	var testcases = []struct {
+		name     string
+		upstream string
+		noProxy  string
+		hits     *atomic.Int32
+		expect   int32
+	}{
+		{"http", "http://kiosk:secret@" + httpProxy.Listener.Addr().String(), "", httpProxyHits, 2},
+		{"socks5", "socks5://kiosk:secret@" + socksProxy.Addr().String(), "", socksProxyHits, 2},
+		{"bypass", "http://kiosk:secret@" + httpProxy.Listener.Addr().String(), "localhost,127.0.0.0/8", httpProxyHits, 0},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			up, err := ParseUpstreamProxy(tc.upstream, tc.noProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var pr = Proxy{Upstream: up}
+
+			proxy := httptest.NewServer(&pr)
+			defer proxy.Close()
+
+			proxyUrl, _ := url.Parse(proxy.URL)
+
+			tr := tlsOrigin.Client().Transport.(*http.Transport).Clone()
+			tr.Proxy = http.ProxyURL(proxyUrl)
+			client := http.Client{Transport: tr}
+
+			before := tc.hits.Load()
+
+			for _, u := range []string{origin.URL + "/plain", tlsOrigin.URL + "/tunnel"} {
+				resp, err := client.Get(u)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if want := "origin " + must(url.Parse(u)).Path; string(body) != want {
+					t.Errorf("%s: got %q", u, body)
+				}
+			}
+
+			if got := tc.hits.Load() - before; got != tc.expect {
+				t.Errorf("upstream proxy used %d times, expect %d", got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestUpstreamSocksResolve(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	socksProxy, _, lastHost := newTestSocksProxy(t, "kiosk", "secret")
+
+	for scheme, expect := range map[string]string{"socks5": "127.0.0.1", "socks5h": "origin.test"} {
+		up, err := ParseUpstreamProxy(scheme+"://kiosk:secret@"+socksProxy.Addr().String(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pr = Proxy{Upstream: up}
+		pr.SetResolver(&Resolver{Records: map[string][]string{"origin.test": {"127.0.0.1"}}})
+
+		pr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://origin.test:"+port+"/", nil))
+
+		if got := lastHost.Load(); got != expect {
+			t.Errorf("%s: proxy asked for %v, expect %s", scheme, got, expect)
+		}
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
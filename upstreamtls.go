@@ -0,0 +1,304 @@
+package chromekiosk
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// UpstreamTLS is the policy for TLS connections made by the proxy. RootCAs
+// are PEM files of certificates trusted in addition to the system roots,
+// for all hosts; the first rule matching a host may extend or relax this.
+type UpstreamTLS struct {
+	RootCAs []string          `json:"rootCAs,omitempty"`
+	Rules   []UpstreamTLSRule `json:"rules,omitempty"`
+
+	once     sync.Once
+	err      error
+	roots    *x509.CertPool
+	active   []*upstreamTLSPolicy
+	fallback *upstreamTLSPolicy
+}
+
+// UpstreamTLSRule applies to hosts matching Hosts, or all hosts if empty.
+//
+// Pins are base64 SHA-256 hashes of a SubjectPublicKeyInfo, as printed by
+// "openssl x509 -pubkey | openssl pkey -pubin -outform der | openssl dgst
+// -sha256 -binary | base64", optionally prefixed by "sha256/". If any are
+// given, the certificate presented, or one it is verified as chaining to,
+// must match.
+//
+// Insecure skips verification of the certificate chain and hostname, for
+// devices with self-signed certificates; pins are still checked.
+type UpstreamTLSRule struct {
+	Hosts      []string `json:"hosts,omitempty"`
+	RootCAs    []string `json:"rootCAs,omitempty"`
+	Pins       []string `json:"pins,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"`
+	MinVersion string   `json:"minVersion,omitempty"` // "1.0" to "1.3", default 1.2
+}
+
+type upstreamTLSPolicy struct {
+	*UpstreamTLSRule
+	roots      *x509.CertPool
+	pins       [][sha256.Size]byte
+	minVersion uint16
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func ReadUpstreamTLSFile(name string) (*UpstreamTLS, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ut UpstreamTLS
+	if err := json.Unmarshal(data, &ut); err != nil {
+		return nil, fmt.Errorf("upstream TLS %s: %w", name, err)
+	}
+
+	if err := ut.init(); err != nil {
+		return nil, fmt.Errorf("upstream TLS %s: %w", name, err)
+	}
+
+	return &ut, nil
+}
+
+// init reads the root certificates and checks the rules.
+func (ut *UpstreamTLS) init() error {
+	ut.once.Do(func() {
+		var errs []error
+
+		if len(ut.RootCAs) > 0 {
+			ut.roots, ut.err = loadRoots(nil, ut.RootCAs)
+			if ut.err != nil {
+				return
+			}
+		}
+
+		for i := range ut.Rules {
+			rule := &ut.Rules[i]
+			policy := &upstreamTLSPolicy{UpstreamTLSRule: rule, roots: ut.roots}
+
+			if len(rule.RootCAs) > 0 {
+				roots, err := loadRoots(ut.roots, rule.RootCAs)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+				}
+				policy.roots = roots
+			}
+
+			for _, pin := range rule.Pins {
+				hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+				if err != nil || len(hash) != sha256.Size {
+					errs = append(errs, fmt.Errorf("rule %d: bad pin %q", i, pin))
+					continue
+				}
+				policy.pins = append(policy.pins, [sha256.Size]byte(hash))
+			}
+
+			if v := rule.MinVersion; v != "" {
+				var ok bool
+				if policy.minVersion, ok = tlsVersions[v]; !ok {
+					errs = append(errs, fmt.Errorf("rule %d: unknown TLS version %q", i, v))
+				}
+			}
+
+			ut.active = append(ut.active, policy)
+		}
+
+		ut.fallback = &upstreamTLSPolicy{UpstreamTLSRule: &UpstreamTLSRule{}, roots: ut.roots}
+		ut.err = errors.Join(errs...)
+	})
+	return ut.err
+}
+
+// loadRoots returns a copy of base, or the system roots if nil, with the
+// certificates in the PEM files added.
+func loadRoots(base *x509.CertPool, files []string) (*x509.CertPool, error) {
+	var roots *x509.CertPool
+	if base != nil {
+		roots = base.Clone()
+	} else {
+		var err error
+		if roots, err = x509.SystemCertPool(); err != nil {
+			roots = x509.NewCertPool()
+		}
+	}
+
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", name)
+		}
+	}
+
+	return roots, nil
+}
+
+// policy returns the policy for host, or an error if ut is not usable, in
+// which case no connection should be made rather than one without it.
+func (ut *UpstreamTLS) policy(host string) (*upstreamTLSPolicy, error) {
+	if ut == nil {
+		return nil, nil
+	}
+
+	if err := ut.init(); err != nil {
+		return nil, err
+	}
+
+	host = canonicalHostname(host)
+
+	for _, policy := range ut.active {
+		if len(policy.Hosts) == 0 || matchHostGlobs(policy.Hosts, host) {
+			return policy, nil
+		}
+	}
+
+	return ut.fallback, nil
+}
+
+func (pr *Proxy) UpstreamTLS() *UpstreamTLS { return pr.upstreamTLS.Load() }
+
+// SetUpstreamTLS atomically replaces the policy for TLS connections made by
+// the default transport, and closes idle connections made under the old
+// one. A policy with bad rules is rejected, leaving the old one in place.
+func (pr *Proxy) SetUpstreamTLS(ut *UpstreamTLS) error {
+	if ut != nil {
+		if err := ut.init(); err != nil {
+			return fmt.Errorf("upstream TLS: %w", err)
+		}
+	}
+
+	pr.upstreamTLS.Store(ut)
+	pr.closeIdleConnections()
+	return nil
+}
+
+func (pr *Proxy) LoadUpstreamTLSFile(name string) error {
+	ut, err := ReadUpstreamTLSFile(name)
+	if err != nil {
+		return err
+	}
+
+	return pr.SetUpstreamTLS(ut)
+}
+
+// dialTLS opens TLS connections for the default transport, so that the
+// configuration can depend on the host. For a request mapped with
+// hostTargetKey, addr still names the requested host, which is used for
+// SNI, verification, client certificates and the policy.
+func (pr *Proxy) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := pr.upstreamTLSConfig(host)
+	if err != nil {
+		pr.logger("proxy").Warn("TLS policy", "host", addr, "err", err)
+		return nil, err
+	}
+
+	conn, err := pr.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		pr.logger("proxy").Warn("TLS handshake", "host", addr, "err", err)
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (pr *Proxy) upstreamTLSConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: host,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if cc := pr.Credentials().certificate(host); cc != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := cc.get()
+			if err != nil {
+				pr.logger("proxy").Warn("client certificate", "host", host, "file", cc.certFile, "err", err)
+			}
+			if cert == nil {
+				return nil, err
+			}
+			return cert, nil
+		}
+	}
+
+	policy, err := pr.UpstreamTLS().policy(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != nil {
+		config.RootCAs = policy.roots
+		config.MinVersion = policy.minVersion
+		config.InsecureSkipVerify = policy.Insecure
+
+		if len(policy.pins) > 0 {
+			config.VerifyConnection = policy.verifyPins
+		}
+	}
+
+	return config, nil
+}
+
+// verifyPins matches the pins against the leaf certificate, whose key the
+// handshake proves the peer holds, and the chains it was verified through.
+// Other certificates presented prove nothing, as anyone can send them.
+func (p *upstreamTLSPolicy) verifyPins(cs tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		certs = append(certs, cs.PeerCertificates[0])
+	}
+	if !p.Insecure {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range p.pins {
+			if hash == pin {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("tls: no certificate for %s matches the pinned keys", cs.ServerName)
+}
+
+func (pr *Proxy) closeIdleConnections() {
+	if tr, ok := pr.transport().(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
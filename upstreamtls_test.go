@@ -0,0 +1,159 @@
+package chromekiosk
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProxyUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	upstream.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	upstream.Config.ErrorLog = log.New(io.Discard, "", 0)
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	var (
+		dir      = t.TempDir()
+		rootFile = filepath.Join(dir, "root.pem")
+		cert     = upstream.Certificate()
+		spki     = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pin      = base64.StdEncoding.EncodeToString(spki[:])
+	)
+
+	if err := os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var pr Proxy
+
+	get := func() int {
+		r := httptest.NewRequest("GET", upstream.URL+"/", nil)
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, test := range []struct {
+		name string
+		ut   *UpstreamTLS
+		want int
+	}{
+		{"system roots", nil, http.StatusBadGateway},
+		{"root", &UpstreamTLS{RootCAs: []string{rootFile}}, http.StatusOK},
+		{"other host root", &UpstreamTLS{Rules: []UpstreamTLSRule{{Hosts: []string{"dashboard.test"}, RootCAs: []string{rootFile}}}}, http.StatusBadGateway},
+		{"insecure", &UpstreamTLS{Rules: []UpstreamTLSRule{{Hosts: []string{"127.0.0.1"}, Insecure: true}}}, http.StatusOK},
+		{"pinned", &UpstreamTLS{Rules: []UpstreamTLSRule{{Insecure: true, Pins: []string{"sha256/" + pin}}}}, http.StatusOK},
+		{"mispinned", &UpstreamTLS{Rules: []UpstreamTLSRule{{Insecure: true, Pins: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}}}, http.StatusBadGateway},
+		{"min version", &UpstreamTLS{Rules: []UpstreamTLSRule{{Insecure: true, MinVersion: "1.3"}}}, http.StatusBadGateway},
+	} {
+		if err := pr.SetUpstreamTLS(test.ut); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := get(); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+
+	// A mapped host is verified and pinned under its own name, not that of
+	// the address it is mapped to.
+	mapped := Proxy{HostMap: map[string]string{"example.com": upstream.Listener.Addr().String()}}
+
+	for _, test := range []struct {
+		name string
+		pin  string
+		want int
+	}{
+		{"mapped pinned", pin, http.StatusOK},
+		{"mapped mispinned", base64.StdEncoding.EncodeToString(make([]byte, 32)), http.StatusBadGateway},
+	} {
+		if err := mapped.SetUpstreamTLS(&UpstreamTLS{Rules: []UpstreamTLSRule{{Hosts: []string{"example.com"}, RootCAs: []string{rootFile}, Pins: []string{test.pin}}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		mapped.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	// A pinned certificate sent after another leaf does not satisfy the pin.
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := ca.Certificate("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := httptest.NewUnstartedServer(upstream.Config.Handler)
+	forged.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Certificate[0], cert.Raw},
+		PrivateKey:  leaf.PrivateKey,
+	}}}
+	forged.Config.ErrorLog = log.New(io.Discard, "", 0)
+	forged.StartTLS()
+	defer forged.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Root().Leaf.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		rule UpstreamTLSRule
+		want int
+	}{
+		{"forged insecure", UpstreamTLSRule{Insecure: true, Pins: []string{pin}}, http.StatusBadGateway},
+		{"forged verified", UpstreamTLSRule{RootCAs: []string{caFile}, Pins: []string{pin}}, http.StatusBadGateway},
+		{"forged unpinned", UpstreamTLSRule{RootCAs: []string{caFile}}, http.StatusOK},
+	} {
+		if err := pr.SetUpstreamTLS(&UpstreamTLS{Rules: []UpstreamTLSRule{test.rule}}); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		pr.ServeHTTP(w, httptest.NewRequest("GET", forged.URL+"/", nil))
+
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	// A bad policy is refused, and one that slips past is not ignored.
+	bad := &UpstreamTLS{Rules: []UpstreamTLSRule{{Pins: []string{"not a pin"}}}}
+
+	if err := pr.SetUpstreamTLS(bad); err == nil || pr.UpstreamTLS() == bad {
+		t.Errorf("bad pin accepted: %v", err)
+	}
+
+	pr.upstreamTLS.Store(bad)
+	pr.closeIdleConnections()
+
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, httptest.NewRequest("GET", forged.URL+"/", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("bad policy ignored: got %d", w.Code)
+	}
+
+	if err := (&UpstreamTLS{Rules: []UpstreamTLSRule{{MinVersion: "2"}}}).init(); err == nil {
+		t.Errorf("bad version accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package chromekiosk
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Handle registers h to serve requests for the virtual host in-process,
+// instead of forwarding them upstream. HTTPS requests for the host are
+// intercepted when CA is set, regardless of Intercept. A nil h removes the
+// registration.
+func (pr *Proxy) Handle(host string, h http.Handler) {
+	pr.handle(host, h, false)
+}
+
+// handlePlain registers h like Handle, but without intercepting HTTPS for
+// the host, so that h only sees its plain HTTP requests unless Intercept is
+// set.
+func (pr *Proxy) handlePlain(host string, h http.Handler) {
+	pr.handle(host, h, true)
+}
+
+func (pr *Proxy) handle(host string, h http.Handler, plain bool) {
+	host = canonicalHostname(host)
+
+	pr.vhostMu.Lock()
+	defer pr.vhostMu.Unlock()
+
+	delete(pr.plainVhosts, host)
+
+	if h == nil {
+		delete(pr.vhosts, host)
+		return
+	}
+
+	if pr.vhosts == nil {
+		pr.vhosts = make(map[string]http.Handler)
+	}
+	pr.vhosts[host] = h
+
+	if plain {
+		if pr.plainVhosts == nil {
+			pr.plainVhosts = make(map[string]bool)
+		}
+		pr.plainVhosts[host] = true
+	}
+}
+
+func (pr *Proxy) HandleFunc(host string, fn func(http.ResponseWriter, *http.Request)) {
+	pr.Handle(host, http.HandlerFunc(fn))
+}
+
+// vhost returns the in-process handler for host, if any.
+func (pr *Proxy) vhost(host string) http.Handler {
+	host = canonicalHostname(host)
+
+	pr.vhostMu.RLock()
+	h, ok := pr.vhosts[host]
+	pr.vhostMu.RUnlock()
+
+	if ok {
+		return h
+	}
+
+	if b, ok := pr.Content[host]; ok {
+		return b
+	}
+
+	return nil
+}
+
+// interceptHost reports whether CONNECT tunnels to host are intercepted.
+func (pr *Proxy) interceptHost(host string) bool {
+	if pr.CA == nil {
+		return false
+	}
+
+	if pr.Intercept {
+		return true
+	}
+
+	pr.vhostMu.RLock()
+	plain := pr.plainVhosts[canonicalHostname(host)]
+	pr.vhostMu.RUnlock()
+
+	return !plain && pr.vhost(host) != nil
+}
+
+func canonicalHostname(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
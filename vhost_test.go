@@ -0,0 +1,66 @@
+package chromekiosk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyHandle(t *testing.T) {
+	ca, err := NewCertAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pr = Proxy{CA: ca}
+
+	pr.HandleFunc("settings.kiosk.localhost", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "settings "+r.URL.Scheme+" "+r.URL.Path)
+	})
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root().Leaf)
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+
+	var testcases = []struct {
+		url    string
+		expect string
+	}{
+		{"http://settings.kiosk.localhost/a", "settings http /a"},
+		{"https://Settings.Kiosk.localhost/b", "settings https /b"},
+	}
+
+	for _, tc := range testcases {
+		resp, err := client.Get(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != tc.expect {
+			t.Errorf("%s: got %q", tc.url, body)
+		}
+	}
+
+	pr.Handle("settings.kiosk.localhost", nil)
+
+	if pr.vhost("settings.kiosk.localhost") != nil {
+		t.Errorf("handler not removed")
+	}
+}
@@ -2,86 +2,44 @@ package chromekiosk
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	cryptorand "crypto/rand"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func makeCertificate() (*tls.Certificate, error) {
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
-	if err != nil {
-		return nil, err
-	}
-
-	var (
-		now      = time.Now()
-		template = &x509.Certificate{
-			Subject: pkix.Name{
-				Organization:       []string{"go.pdmccormick.com"},
-				OrganizationalUnit: []string{"chromekiosk"},
-				CommonName:         "proxy",
-			},
-
-			NotBefore: now.AddDate(0, -1, 0),
-			NotAfter:  now.AddDate(0, 1, 0),
-
-			KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-
-			BasicConstraintsValid: true,
-			IsCA:                  true,
-			MaxPathLenZero:        true,
-		}
-	)
-
-	certDer, err := x509.CreateCertificate(cryptorand.Reader, template, template, priv.Public(), priv)
-	if err != nil {
-		return nil, err
-	}
-
-	cert, err := x509.ParseCertificate(certDer)
-	if err != nil {
-		return nil, err
-	}
-
-	var tlsCert = tls.Certificate{
-		Certificate: [][]byte{certDer},
-		PrivateKey:  priv,
-		Leaf:        cert,
-	}
-
-	return &tlsCert, nil
-}
-
-func runTLSProxy(ctx context.Context, ln net.Listener, h http.Handler) error {
+func runTLSProxy(ctx context.Context, ln net.Listener, h http.Handler, ca *CertAuthority) error {
 	if h == nil {
 		h = &DefaultProxyHandler
 	}
 
-	tlsCert, err := makeCertificate()
+	host, _, err := net.SplitHostPort(ln.Addr().String())
 	if err != nil {
 		return err
 	}
 
 	var (
 		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{*tlsCert},
-			MinVersion:   tls.VersionTLS13,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				name := hello.ServerName
+				if name == "" {
+					name = host
+				}
+				return ca.Certificate(name)
+			},
+			MinVersion: tls.VersionTLS13,
+			NextProtos: []string{"h2", "http/1.1"},
 		}
 		serv = http.Server{
 			Handler:     h,
@@ -91,51 +49,91 @@ func runTLSProxy(ctx context.Context, ln net.Listener, h http.Handler) error {
 		tlsListener = tls.NewListener(ln, tlsConfig)
 	)
 
-	return serv.Serve(tlsListener)
-}
-
-var InternalChromeRequests = []string{
-	"CONNECT //accounts.google.com:443",
-	"CONNECT //content-autofill.googleapis.com:443",
-	"CONNECT //optimizationguide-pa.googleapis.com:443",
-	"CONNECT //safebrowsingohttpgateway.googleapis.com:443",
-	"CONNECT //update.googleapis.com:443",
-	"CONNECT //www.google.com:443",
-	"GET http://clients2.google.com/time/1/current?",
-	"POST http://update.googleapis.com/service/update2/json?",
-}
-
-func IsInternalChromeRequest(r *http.Request) bool {
-	return isInternalChromeRequestStr(r.Method + " " + r.URL.String())
-}
-
-func isInternalChromeRequestStr(urlStr string) bool {
-	urls := InternalChromeRequests
-	n, _ := slices.BinarySearch(urls, urlStr)
-
-	if n > 1 {
-		if strings.HasPrefix(urlStr, urls[n-1]) {
-			return true
-		}
+	if pr, ok := h.(*Proxy); ok {
+		serv.ErrorLog = pr.errorLog()
 	}
 
-	if n == len(urls) {
-		n--
-	}
-
-	if urlStr == urls[n] {
-		return true
-	}
-
-	return false
+	return serv.Serve(tlsListener)
 }
 
 type Proxy struct {
-	Log                 *log.Logger
+	// Logger receives structured logs. If it is nil, Log is used through
+	// NewLogHandler at Info, if set. Neither may be changed once the proxy
+	// is in use.
+	Logger *slog.Logger
+	Log    *log.Logger
+
 	Dialer              net.Dialer
 	Transport           http.RoundTripper
 	AllowChromeInternal bool
-	HostMap             map[string]string
+
+	// If LearnInternal is set, it records candidate Chrome background
+	// requests; see SetInternalRequests.
+	LearnInternal *InternalRequestLearner
+
+	// HostMap translates hostnames before dialing upstream. Keys may be
+	// globs and values are as for ParseHostTarget; see also SetHosts. It is
+	// compiled on first use, and must not be changed after that. Entries
+	// that cannot be used are skipped with a warning, and Monitor will not
+	// start with any.
+	HostMap map[string]string
+
+	// If Intercept is set, CONNECT tunnels are decrypted using leaf
+	// certificates signed by CA, so that their requests pass through the
+	// same policy and forwarding as plain HTTP.
+	Intercept bool
+	CA        *CertAuthority
+
+	Cache *Cache
+
+	// Content serves virtual hosts, keyed by lower case hostname, straight
+	// from the proxy, like handlers registered with Handle.
+	Content map[string]*ContentBundle
+
+	// ErrorPage renders upstream failures for page loads, using
+	// ErrorPageData; if nil, DefaultErrorPageTemplate is used.
+	ErrorPage *template.Template
+
+	// ErrorLogo is shown on the error page; see LoadErrorLogo.
+	ErrorLogo template.URL
+
+	Middleware []ProxyMiddleware
+
+	// If Via is set, it is added as the pseudonym of this proxy in Via
+	// headers. If ForwardedFor is set, the client address is appended to
+	// X-Forwarded-For.
+	Via          string
+	ForwardedFor bool
+
+	HAR *HARRecorder
+
+	// If Cookies is set, upstream requests carry its cookies and it
+	// captures those set in responses.
+	Cookies *CookieJar
+
+	Upstream *UpstreamProxy
+
+	policy      atomic.Pointer[Policy]
+	hosts       atomic.Pointer[HostTable]
+	hostMapOnce sync.Once
+	hostMap     *HostTable
+	hostMapErr  error
+	credentials atomic.Pointer[Credentials]
+	internal    atomic.Pointer[InternalRequestMatcher]
+	throttle    atomic.Pointer[Throttle]
+	throttling  atomic.Bool
+	resolver    atomic.Pointer[Resolver]
+	upstreamTLS atomic.Pointer[UpstreamTLS]
+
+	vhostMu     sync.RWMutex
+	vhosts      map[string]http.Handler
+	plainVhosts map[string]bool // Registered with handlePlain
+
+	transportOnce    sync.Once
+	defaultTransport http.RoundTripper
+
+	loggersOnce sync.Once
+	loggers     map[string]*slog.Logger
 }
 
 var (
@@ -151,20 +149,78 @@ var DefaultProxyHandler = Proxy{
 	},
 }
 
+func (pr *Proxy) Policy() *Policy { return pr.policy.Load() }
+
+// SetPolicy atomically replaces the allow/deny policy; a nil policy allows
+// everything.
+func (pr *Proxy) SetPolicy(p *Policy) { pr.policy.Store(p) }
+
+func (pr *Proxy) LoadPolicyFile(name string) error {
+	p, err := ReadPolicyFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetPolicy(p)
+	return nil
+}
+
+func (pr *Proxy) Credentials() *Credentials { return pr.credentials.Load() }
+
+// SetCredentials atomically replaces the per-host credentials that
+// RoundTrip attaches to upstream requests. Idle connections are closed, so
+// that new client certificates take effect.
+func (pr *Proxy) SetCredentials(c *Credentials) {
+	pr.credentials.Store(c)
+	pr.closeIdleConnections()
+}
+
+func (pr *Proxy) LoadCredentialsFile(name string) error {
+	c, err := ReadCredentialsFile(name)
+	if err != nil {
+		return err
+	}
+
+	pr.SetCredentials(c)
+	return nil
+}
+
 func (pr *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
-	tr := pr.Transport
-	if tr == nil {
-		tr = http.DefaultTransport
+	tr := pr.transport()
+
+	if hdr := pr.Credentials().header(req.URL.Hostname()); hdr != nil {
+		req = req.Clone(req.Context())
+		for k, vs := range hdr {
+			req.Header[k] = vs
+		}
+	}
+
+	if j := pr.Cookies; j != nil {
+		req = j.addCookies(req)
 	}
 
-	if pr.HostMap != nil {
-		if target, ok := pr.HostMap[req.URL.Hostname()]; ok {
+	var (
+		host = req.URL.Hostname()
+		u    = req.URL
+	)
+
+	if target, ok := pr.mapHost(host); ok {
+		if target.Unix != "" {
+			// Only the default transport knows to dial the socket.
+			if pr.Transport != nil {
+				return nil, fmt.Errorf("host %s: unix socket target %s requires the default Transport", host, target.Unix)
+			}
+
+			req = req.WithContext(context.WithValue(req.Context(), unixSocketKey{}, target.Unix))
+		} else if req.URL.Scheme == "https" && pr.Transport == nil {
+			req = req.WithContext(context.WithValue(req.Context(), hostTargetKey{}, target))
+		} else {
 			u := *req.URL
 
-			if port := u.Port(); port != "" {
-				u.Host = net.JoinHostPort(target, port)
+			if port := u.Port(); port != "" || target.Port != "" {
+				u.Host = target.addr(port)
 			} else {
-				u.Host = target
+				u.Host = target.Host
 			}
 
 			req0 := *req
@@ -173,40 +229,118 @@ func (pr *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	return tr.RoundTrip(req)
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	if at := pr.throttleFor(host); at != nil {
+		resp, err = at.roundTrip(tr, req)
+	} else {
+		resp, err = tr.RoundTrip(req)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if j := pr.Cookies; j != nil {
+		j.capture(u, resp)
+	}
+
+	// Upgraded connections are left as they are, for upgrade to take over.
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = meteredBody{resp.Body, metricProxyReceivedBytes}
+	}
+
+	return resp, nil
+}
+
+// addsCredentials reports whether RoundTrip adds an Authorization header or
+// cookies to req, making the response private to it.
+func (pr *Proxy) addsCredentials(req *http.Request) bool {
+	hdr := pr.Credentials().header(req.URL.Hostname())
+	if hdr.Get("Authorization") != "" || hdr.Get("Cookie") != "" {
+		return true
+	}
+
+	return pr.Cookies != nil && len(pr.Cookies.matching(req)) > 0
 }
 
 func (pr *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !pr.AllowChromeInternal && IsInternalChromeRequest(r) {
+	if r.Method == http.MethodConnect && r.Header.Get(":protocol") != "" {
+		r = extendedConnect(r)
+	}
+
+	if pr.blockInternal(r) {
 		http.Error(w, "", http.StatusGatewayTimeout)
 		return
 	}
 
-	pr.logf("proxy: %s %s", r.Method, r.URL)
+	if !pr.checkPolicy(w, r) {
+		return
+	}
+
+	pr.logger("proxy").Debug("request start", "method", r.Method, "url", r.URL.String())
 
 	if r.Method == "CONNECT" {
 		pr.connect(w, r)
 		return
 	}
 
+	if h := pr.vhost(r.URL.Hostname()); h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+
 	pr.passthru(w, r)
 }
 
-func (pr *Proxy) logf(format string, v ...any) {
-	if l := pr.Log; l != nil {
-		l.Output(2, fmt.Sprintf(format, v...))
+func (pr *Proxy) checkPolicy(w http.ResponseWriter, r *http.Request) bool {
+	action, target := pr.Policy().Decide(r)
+
+	switch action {
+	case PolicyAllow:
+		return true
+
+	case PolicyRedirect:
+		if r.Method != http.MethodConnect {
+			pr.logger("proxy").Info("policy redirect", "method", r.Method, "url", r.URL.String(), "status", http.StatusFound, "location", target)
+			http.Redirect(w, r, target, http.StatusFound)
+			return false
+		}
 	}
+
+	pr.logger("proxy").Info("policy deny", "method", r.Method, "url", r.URL.String(), "status", http.StatusForbidden)
+	http.Error(w, "", http.StatusForbidden)
+	return false
 }
 
-func (pr *Proxy) passthru(w http.ResponseWriter, r *http.Request) {
-	var (
-		src = r.URL
-		dst = url.URL{
-			Scheme: src.Scheme,
-			Host:   src.Host,
-			Path:   src.Path,
+// logger returns the logger for component, from Logger, or else Log at
+// Info, which are read on first use.
+func (pr *Proxy) logger(component string) *slog.Logger {
+	pr.loggersOnce.Do(func() {
+		l := logger(pr.Logger, pr.Log, slog.LevelInfo)
+		pr.loggers = map[string]*slog.Logger{
+			"proxy": l.With("component", "proxy"),
+			"socks": l.With("component", "socks"),
 		}
-	)
+	})
+	return pr.loggers[component]
+}
+
+// errorLog is for http.Servers, which log to the standard logger if it is
+// nil.
+func (pr *Proxy) errorLog() *log.Logger {
+	if pr.Logger == nil && pr.Log == nil {
+		return nil
+	}
+	return slog.NewLogLogger(pr.logger("proxy").Handler(), slog.LevelWarn)
+}
+
+func (pr *Proxy) passthru(w http.ResponseWriter, r *http.Request) {
+	dst := *r.URL
+	dst.User = nil
 
 	if dst.Scheme == "" {
 		dst.Scheme = "http"
@@ -216,47 +350,122 @@ func (pr *Proxy) passthru(w http.ResponseWriter, r *http.Request) {
 		dst.Host = r.Host
 	}
 
-	req, err := http.NewRequest(r.Method, dst.String(), r.Body)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, dst.String(), r.Body)
 	if err != nil {
-		pr.logf("proxy: %s %s: NewRequest %s", r.Method, r.URL, err)
+		pr.logger("proxy").Warn("bad request", "method", r.Method, "url", r.URL.String(), "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	req.Header = r.Header.Clone()
+	req.ContentLength = r.ContentLength
+	req.Trailer = r.Trailer
+
+	// The body of an upgrade over HTTP/2 is the stream itself.
+	if r.ContentLength == 0 || upgradeType(r.Header) != "" {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+	}
+
+	pr.forwardRequestHeader(req, r)
+
+	if err := pr.modifyRequest(req); err != nil {
+		pr.logger("proxy").Warn("middleware", "method", r.Method, "url", r.URL.String(), "err", err)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+
+	var (
+		resp        *http.Response
+		host        = r.URL.Hostname()
+		har         = pr.HAR.begin(r, req, pr.Credentials().header(host))
+		start       = time.Now()
+		cacheStatus CacheStatus
+	)
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = meteredBody{req.Body, metricProxySentBytes}
+	}
+
+	if c := pr.Cache; c != nil && !pr.addsCredentials(req) {
+		resp, cacheStatus, err = c.roundTrip(req, pr)
+	} else {
+		resp, err = pr.RoundTrip(req)
+	}
 
-	resp, err := pr.RoundTrip(req)
 	if err != nil {
-		pr.logf("proxy: %s %s: RoundTrip %s", r.Method, r.URL, err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		pr.logger("proxy").Warn("upstream error", "method", r.Method, "url", r.URL.String(), "host", host,
+			"duration", time.Since(start), "err", err)
+		metricProxyRequests.Inc(hostLabel(host), "error")
+		har.finish(0, err)
+		pr.upstreamError(w, r, upstreamErrorStatus(err))
 		return
 	}
 
 	defer resp.Body.Close()
 
-	hdr := w.Header()
+	metricProxyUpstreamLatency.Observe(time.Since(start).Seconds(), hostLabel(host))
+	metricProxyRequests.Inc(hostLabel(host), strconv.Itoa(resp.StatusCode))
 
-	for k, vs := range resp.Header {
-		for _, v := range vs {
-			hdr.Add(k, v)
-		}
+	if err := pr.modifyResponse(resp); err != nil {
+		pr.logger("proxy").Warn("middleware", "method", r.Method, "url", r.URL.String(), "err", err)
+		har.finish(0, err)
+		http.Error(w, "", http.StatusBadGateway)
+		return
 	}
 
-	hdr.Set("Connection", "close")
-	hdr.Del("Content-Length")
+	har.response(resp)
 
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		har.finish(0, nil)
+		pr.upgrade(w, r, resp)
+		return
+	}
+
+	pr.forwardResponseHeader(w, resp)
+
+	// Streamed responses of unknown length, such as server-sent events,
+	// are flushed as they arrive.
 	var flush = func() {}
-	if f, ok := w.(http.Flusher); ok {
+	if f, ok := w.(http.Flusher); ok && resp.ContentLength < 0 {
 		flush = f.Flush
 	}
 
 	w.WriteHeader(resp.StatusCode)
 
-	var raw = make([]byte, 4096)
+	var (
+		raw     = make([]byte, 32<<10)
+		written int64
+		harBody = har.body()
+		bodyErr error
+	)
+
+	defer func() {
+		har.finish(written, bodyErr)
+
+		attrs := []any{"method", r.Method, "url", r.URL.String(), "host", host,
+			"status", resp.StatusCode, "duration", time.Since(start), "bytes", written}
+		if cacheStatus != "" {
+			attrs = append(attrs, "cache", cacheStatus)
+		}
+		if bodyErr != nil {
+			attrs = append(attrs, "err", bodyErr)
+		}
+		pr.logger("proxy").Info("request", attrs...)
+	}()
+
 	for {
 		n, err := resp.Body.Read(raw)
 		if n == 0 && err != nil {
-			return
+			if err == io.EOF {
+				forwardTrailer(w, resp)
+				return
+			}
+
+			// Reset the client connection or stream, so that the truncated
+			// body is not taken to be complete.
+			bodyErr = err
+			panic(http.ErrAbortHandler)
 		}
 
 		buf := raw[:n]
@@ -265,51 +474,128 @@ func (pr *Proxy) passthru(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		written += int64(n)
+		harBody.Write(buf)
+
 		flush()
 	}
 }
 
 func (pr *Proxy) connect(w http.ResponseWriter, r *http.Request) {
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "ResponseWriter does not implement http.Hijacker", http.StatusInternalServerError)
+	addr := net.JoinHostPort(r.URL.Hostname(), r.URL.Port())
+
+	if pr.interceptHost(r.URL.Hostname()) {
+		conn, err := pr.acceptTunnel(w, r)
+		if err != nil {
+			return
+		}
+
+		metricProxyTunnels.Inc()
+		defer metricProxyTunnels.Dec()
+
+		pr.intercept(r.Context(), conn, tunnelReader(conn), addr)
 		return
 	}
 
-	addr := net.JoinHostPort(r.URL.Hostname(), r.URL.Port())
-	pr.logf("CONNECT %s", addr)
-
-	upconn, err := pr.Dialer.DialContext(r.Context(), "tcp", addr)
+	upconn, err := pr.dialTarget(r.Context(), addr)
 	if err != nil {
-		pr.logf("dial %s error: %s", addr, err)
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			http.Error(w, err.Error(), http.StatusGatewayTimeout)
-		} else {
-			http.Error(w, err.Error(), http.StatusBadGateway)
-		}
+		pr.logger("proxy").Warn("dial", "method", r.Method, "host", addr, "err", err)
+		metricProxyRequests.Inc(hostLabel(r.URL.Hostname()), "error")
+		pr.upstreamError(w, r, upstreamErrorStatus(err))
 		return
 	}
 
 	defer upconn.Close()
 
-	w.WriteHeader(http.StatusOK)
-
-	conn, bufrw, err := hj.Hijack()
+	conn, err := pr.acceptTunnel(w, r)
 	if err != nil {
 		return
 	}
 
-	if bufr := bufrw.Reader; bufr.Buffered() > 0 {
-		if _, err := io.Copy(upconn, bufr); err != nil {
+	metricProxyRequests.Inc(hostLabel(r.URL.Hostname()), "200")
+	metricProxyTunnels.Inc()
+	defer metricProxyTunnels.Dec()
+
+	start := time.Now()
+	teeConn(conn, meteredConn{upconn})
+
+	pr.logger("proxy").Info("tunnel", "method", r.Method, "host", addr, "status", http.StatusOK, "duration", time.Since(start))
+}
+
+// upgrade completes a protocol upgrade such as a WebSocket handshake,
+// forwarding the 101 response and then tunnelling both directions.
+func (pr *Proxy) upgrade(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	upconn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		pr.logger("proxy").Warn("upgrade response body is not writable", "method", r.Method, "url", r.URL.String())
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+
+	if want, got := r.Header.Get("Upgrade"), resp.Header.Get("Upgrade"); !strings.EqualFold(want, got) {
+		pr.logger("proxy").Warn("upgrade mismatch", "method", r.Method, "url", r.URL.String(), "upgrade", want, "switched", got)
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+
+	var conn net.Conn
+
+	if r.ProtoMajor >= 2 {
+		// An extended CONNECT stream is accepted with 200 rather than 101.
+		removeHopByHop(resp.Header)
+		resp.Header.Del("Sec-Websocket-Accept")
+
+		hdr := w.Header()
+		for k, vs := range resp.Header {
+			hdr[k] = vs
+		}
+
+		var err error
+		if conn, err = pr.acceptTunnel(w, r); err != nil {
+			upconn.Close()
+			return
+		}
+	} else {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "ResponseWriter does not implement http.Hijacker", http.StatusInternalServerError)
+			return
+		}
+
+		hjconn, bufrw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(bufrw, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(bufrw)
+		bufrw.WriteString("\r\n")
+
+		if err := bufrw.Flush(); err != nil {
+			hjconn.Close()
+			upconn.Close()
 			return
 		}
 
-		bufr.Reset(nil)
+		conn = &bufConn{Conn: hjconn, r: bufrw.Reader}
 	}
 
+	pr.logger("proxy").Info("upgraded", "method", r.Method, "url", r.URL.String(), "upgrade", r.Header.Get("Upgrade"),
+		"status", http.StatusSwitchingProtocols)
+
+	metricProxyTunnels.Inc()
+	defer metricProxyTunnels.Dec()
+
 	teeConn(conn, upconn)
 }
 
+func upstreamErrorStatus(err error) int {
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 func teeConn(left, right io.ReadWriteCloser) error {
 	var (
 		wg   sync.WaitGroup
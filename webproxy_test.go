@@ -1,35 +1,171 @@
 package chromekiosk
 
 import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func TestInternalChromeRequests(t *testing.T) {
-	var testcases = []struct {
-		expect bool
-		urlStr string
-	}{
-		{true, "CONNECT //accounts.google.com:443"},
-		{true, "CONNECT //optimizationguide-pa.googleapis.com:443"},
-		{true, "CONNECT //safebrowsingohttpgateway.googleapis.com:443"},
-		{true, "CONNECT //update.googleapis.com:443"},
-		{true, "CONNECT //www.google.com:443"},
+func TestProxyErrorPage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	logo := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(logo, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var pr Proxy
+	if pr.ErrorLogo, err = LoadErrorLogo(logo); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://"+addr+"/dashboard", nil)
+	r.Header.Set("Accept", "text/html,*/*")
+	w := httptest.NewRecorder()
+	pr.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	hostname, _ := os.Hostname()
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d", w.Code)
+	}
+
+	if !strings.Contains(body, "<html>") || !strings.Contains(body, hostname) {
+		t.Errorf("missing error page: %s", body)
+	}
+
+	if !strings.Contains(body, `<img src="data:image/png;base64,iVBORw0KGgo=" alt="">`) {
+		t.Errorf("missing logo: %s", body)
+	}
+
+	if strings.Contains(body, "connection refused") {
+		t.Errorf("error page leaks upstream error: %s", body)
+	}
+}
+
+func TestProxyConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	}))
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
 
-		{true, "GET http://clients2.google.com/time/1/current?"},
-		{true, "GET http://clients2.google.com/time/1/current?foo&bar&quux"},
+	var pr = Proxy{
+		HostMap: map[string]string{"kiosk.test": "127.0.0.1"},
+	}
+	pr.SetPolicy(&Policy{
+		Rules:   []PolicyRule{{Action: PolicyAllow, Hosts: []string{"kiosk.test"}}},
+		Default: PolicyDeny,
+	})
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
 
-		{true, "POST http://update.googleapis.com/service/update2/json?x"},
-		{true, "POST http://update.googleapis.com/service/update2/json?foo&bar&quux"},
+	tr := upstream.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(proxyUrl)
+	tr.TLSClientConfig.ServerName = "example.com"
+	client := http.Client{Transport: tr}
+
+	mapped := "https://kiosk.test:" + port + "/"
+
+	resp, err := client.Get(mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
 
-		{false, "GET http://google.com/"},
-		{false, "GET https://google.com/"},
-		{false, "GET https://example.com/"},
+	if want := "hello kiosk.test:" + port; string(body) != want {
+		t.Errorf("%s: got %q", mapped, body)
 	}
 
-	for _, tc := range testcases {
-		got := isInternalChromeRequestStr(tc.urlStr)
-		if tc.expect != got {
-			t.Errorf("mismatch %s", tc.urlStr)
+	if _, err := client.Get(upstream.URL + "/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("%s: expected CONNECT to be denied, got %v", upstream.URL, err)
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		conn, bufrw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer upstream.Close()
+
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	var pr = Proxy{
+		HostMap: map[string]string{"dashboard.test": "127.0.0.1"},
+	}
+	pr.SetPolicy(&Policy{
+		Rules:   []PolicyRule{{Action: PolicyAllow, Hosts: []string{"dashboard.test"}}},
+		Default: PolicyDeny,
+	})
+
+	proxy := httptest.NewServer(&pr)
+	defer proxy.Close()
+
+	upgrade := func(host string) (*http.Response, net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
 		}
+
+		req, _ := http.NewRequest("GET", "http://"+net.JoinHostPort(host, port)+"/ws", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "echo")
+		req.WriteProxy(conn)
+
+		bufr := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(bufr, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, conn, bufr
+	}
+
+	resp, conn, bufr := upgrade("dashboard.test")
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("got %s %v", resp.Status, resp.Header)
+	}
+
+	io.WriteString(conn, "ping")
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(bufr, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo: got %q %v", buf, err)
+	}
+
+	resp, conn, _ = upgrade("127.0.0.1")
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("policy: got %s", resp.Status)
 	}
 }